@@ -6,27 +6,139 @@ import (
 )
 
 func showUsage() {
-	fmt.Printf("USAGE: %s [rebase-todo-file]\n", os.Args[0])
-	fmt.Printf("    Expects a list of instructions to be supplied on standard input.\n")
-	fmt.Printf("    Writes a remastered rebase todo file to standard output.\n")
-	fmt.Printf("    Those instructions must be of the form:\n")
+	fmt.Printf("USAGE: %s [--instructions FILE] [rebase-todo-file]\n", os.Args[0])
+	fmt.Printf("    Expects a list of instructions to be supplied on standard input,\n")
+	fmt.Printf("    and writes a remastered rebase todo file to standard output.\n")
+	fmt.Printf("\n")
+	fmt.Printf("    --instructions FILE\n")
+	fmt.Printf("        Read the instructions from FILE instead, and rewrite the rebase todo\n")
+	fmt.Printf("        file in place. This is suitable for use as a sequence editor:\n")
+	fmt.Printf("            GIT_SEQUENCE_EDITOR=\"%s --instructions plan.txt\" git rebase -i ...\n", os.Args[0])
+	fmt.Printf("\n")
+	fmt.Printf("    --format {lines, json}\n")
+	fmt.Printf("        The format of the instructions. The default, lines, is described\n")
+	fmt.Printf("        below. json is an array of objects, each of the form:\n")
+	fmt.Printf("            {\"action\": COMMAND, \"commit\": COMMIT-ID, \"args\": ARGS,\n")
+	fmt.Printf("             \"trailers\": [{\"action\": COMMAND, \"args\": ARGS}, ...]}\n")
+	fmt.Printf("        where each trailer is a break or exec (or update-ref) for the same\n")
+	fmt.Printf("        commit. args and trailers are optional, and so is action if there\n")
+	fmt.Printf("        are trailers.\n")
+	fmt.Printf("\n")
+	fmt.Printf("    --strict\n")
+	fmt.Printf("        Instructions which don't match anything in the rebase todo file are\n")
+	fmt.Printf("        always warned about. With --strict, they are an error instead, and\n")
+	fmt.Printf("        nothing is written.\n")
+	fmt.Printf("\n")
+	fmt.Printf("    --conflicts {last-wins, first-wins, error}\n")
+	fmt.Printf("        What to do when two instructions give the same COMMIT-ID different\n")
+	fmt.Printf("        commands, like 'drop 1111' and 'pick 1111'. The default, last-wins,\n")
+	fmt.Printf("        keeps the later one, first-wins keeps the earlier one, and both warn\n")
+	fmt.Printf("        about it. error gives up instead. Two moves of the same COMMIT-ID to\n")
+	fmt.Printf("        different places conflict too. break and exec never conflict.\n")
+	fmt.Printf("\n")
+	fmt.Printf("    --orphans {error, leave, drop, pick}\n")
+	fmt.Printf("        What to do with a fixup whose subject names a commit which isn't in the\n")
+	fmt.Printf("        rebase todo file, like one from before the start of the rebase, or a\n")
+	fmt.Printf("        fixup with no commit before it. The default, error, lists every one of\n")
+	fmt.Printf("        them and gives up. leave keeps the line as it was, drop drops the\n")
+	fmt.Printf("        commit, and pick picks it. All three warn about every one of them.\n")
+	fmt.Printf("\n")
+	fmt.Printf("    --instruction-format FORMAT\n")
+	fmt.Printf("        The rebase.instructionFormat git wrote the rebase todo file with, so\n")
+	fmt.Printf("        that subjects can be found in lines like 'pick 1111 (Bob) Foo'. The\n")
+	fmt.Printf("        default is read from git config. '%%s' means just the subject.\n")
+	fmt.Printf("\n")
+	fmt.Printf("    --comment-char CHAR\n")
+	fmt.Printf("        What comment lines in the rebase todo file start with, like git's\n")
+	fmt.Printf("        core.commentChar, which is where the default is read from. auto\n")
+	fmt.Printf("        picks it up from the rebase todo file. Comments in the instructions\n")
+	fmt.Printf("        always start with #.\n")
+	fmt.Printf("\n")
+	fmt.Printf("    --style {preserve, long, short}\n")
+	fmt.Printf("        How commands are written in the rebase todo file, like pick or p.\n")
+	fmt.Printf("        The default, preserve, leaves commands which don't change alone,\n")
+	fmt.Printf("        and writes the rest like the first command in the file, so a todo\n")
+	fmt.Printf("        written with rebase.abbreviateCommands stays abbreviated. long and\n")
+	fmt.Printf("        short write every command, break and exec lines included, one way.\n")
+	fmt.Printf("\n")
+	fmt.Printf("    --dry-run\n")
+	fmt.Printf("        Write nothing. Instead, print a unified diff from the rebase todo file\n")
+	fmt.Printf("        to what it would have become, and a summary of how many commits\n")
+	fmt.Printf("        changed command, moved, or gained break or exec lines.\n")
+	fmt.Printf("\n")
+	fmt.Printf("    Errors and warnings look like FILE:LINE:COL: MESSAGE, which most editors\n")
+	fmt.Printf("    can jump to. FILE is <stdin> for instructions read from standard input.\n")
+	fmt.Printf("    Every bad instruction is reported before giving up, not just the first.\n")
+	fmt.Printf("\n")
+	fmt.Printf("    Instructions must be of the form:\n")
 	fmt.Printf("        [COMMAND] [COMMIT-ID] [ARGS]\n")
 	fmt.Printf("    COMMAND must be a valid rebase command, or its abbreviation,\n")
 	fmt.Printf("            or the special command 'override', or its abbreviation 'o'.\n")
-	fmt.Printf("    COMMIT-ID must be an exactly matching abbreviated commit hash,\n")
-	fmt.Printf("              or the special keyword 'default'.\n")
-	fmt.Printf("    ARGS is only specified if COMMAND = {x, exec}, and is the command to run.\n")
+	fmt.Printf("    COMMIT-ID must be a commit hash, full or abbreviated to at least 4\n")
+	fmt.Printf("              characters, like git allows,\n")
+	fmt.Printf("              or anything git rev-parse understands, like HEAD~3, v1.2^\n")
+	fmt.Printf("              or a branch name, resolved in the current repository,\n")
+	fmt.Printf("              or the special keyword 'default', or a subject selector:\n")
+	fmt.Printf("                  /REGEX/      commits whose subject matches REGEX\n")
+	fmt.Printf("                  msg:TEXT     commits whose subject contains TEXT,\n")
+	fmt.Printf("                               which may be \"quoted\" to include spaces\n")
+	fmt.Printf("              or a range selector:\n")
+	fmt.Printf("                  FROM..TO     every commit from FROM through TO in the\n")
+	fmt.Printf("                               todo file, including both FROM and TO.\n")
+	fmt.Printf("                               Unlike git, FROM itself is included.\n")
+	fmt.Printf("                  FROM..       FROM and every commit after it\n")
+	fmt.Printf("                  ..TO         every commit up to and including TO\n")
+	fmt.Printf("              FROM and TO must be commits which appear in the todo file,\n")
+	fmt.Printf("              in that order.\n")
+	fmt.Printf("    ARGS is only specified if COMMAND = {x, exec}, and is the command to run,\n")
+	fmt.Printf("         or if COMMAND = {f, fixup, s, squash}, and is the commit\n")
+	fmt.Printf("         to fold into. That commit may come before or after this one in the\n")
+	fmt.Printf("         todo file, so an early fix can be folded forward into the commit it\n")
+	fmt.Printf("         belongs to.\n")
+	fmt.Printf("\n")
+	fmt.Printf("    COMMAND may also be {fixup-C, f-C} or {fixup-c, f-c}, which become\n")
+	fmt.Printf("    'fixup -C' and 'fixup -c': fixup, but keep this commit's message\n")
+	fmt.Printf("    instead (-c opens the editor on it first). These relocate just like\n")
+	fmt.Printf("    fixup does. 'fixup -C' and 'fixup -c' lines in the todo file keep their\n")
+	fmt.Printf("    option unless an instruction changes their command.\n")
+	fmt.Printf("\n")
+	fmt.Printf("    A commit whose subject starts with 'fixup! ', 'squash! ' or 'amend! ' and\n")
+	fmt.Printf("    which is made a fixup or squash goes after the nearest commit before it\n")
+	fmt.Printf("    with the rest of that subject or, failing that, after the commit whose\n")
+	fmt.Printf("    hash the rest of the subject is. If several commits have that subject, a\n")
+	fmt.Printf("    warning names all of them. An 'amend! ' commit made a fixup becomes\n")
+	fmt.Printf("    'fixup -C', so its message replaces the other commit's, like git does.\n")
+	fmt.Printf("    The prefixes come off one at a time, so 'fixup! fixup! Foo' goes right\n")
+	fmt.Printf("    after the 'fixup! Foo' it amends, ahead of Foo's other fixups.\n")
+	fmt.Printf("\n")
+	fmt.Printf("    The extra command 'autosquash' does what git's --autosquash would do\n")
+	fmt.Printf("    with a commit, going by the outermost prefix of its subject: 'fixup! '\n")
+	fmt.Printf("    makes a fixup, 'squash! ' a squash and 'amend! ' a 'fixup -C', and any\n")
+	fmt.Printf("    other commit keeps its command. 'autosquash default' does the lot.\n")
 	fmt.Printf("\n")
 	fmt.Printf("    If COMMAND = {x, exec, b, break}, then rather than changing the existing\n")
 	fmt.Printf("    line within the rebase message, a break or exec command will be inserted\n")
 	fmt.Printf("    after it. Such commands will evaluate in the order they are specified in\n")
 	fmt.Printf("    the control instructions.\n")
 	fmt.Printf("\n")
+	fmt.Printf("    Hashes match if either one is an abbreviation of the other, at least 4\n")
+	fmt.Printf("    characters long, so a full hash from git log matches the shorter one in\n")
+	fmt.Printf("    the todo file, and the todo file keeps its own. A hash which could be\n")
+	fmt.Printf("    more than one commit in the todo file is an error. A hash after\n")
+	fmt.Printf("    'fixup! ' matches the same way.\n")
+	fmt.Printf("    A name which git can't resolve to a commit is an error too.\n")
+	fmt.Printf("\n")
 	fmt.Printf("    The special keyword 'default' declares behavior for any commit not\n")
 	fmt.Printf("    explicitly mentioned. For most commands, the specific command takes\n")
 	fmt.Printf("    precedence. For break and exec, both specific and default statements\n")
 	fmt.Printf("    are included, default ones first.\n")
 	fmt.Printf("\n")
+	fmt.Printf("    Subject and range selectors sit between the two: an exact hash takes\n")
+	fmt.Printf("    precedence over every selector, and a selector takes precedence over\n")
+	fmt.Printf("    'default'. If several selectors match a commit, the one given last wins.\n")
+	fmt.Printf("    Breaks and execs go default first, then selectors in order, then the\n")
+	fmt.Printf("    exact hash.\n")
+	fmt.Printf("\n")
 	fmt.Printf("    The special command 'override' and its abbreviation 'o' force\n")
 	fmt.Printf("    the line from the rebase todo list to be echoed verbatim.  It is useful\n")
 	fmt.Printf("    for overriding the behavior specified for the 'default' keyword, and\n")
@@ -36,7 +148,42 @@ func showUsage() {
 	fmt.Printf("\n")
 	fmt.Printf("    The default behavior is to use the command specified by rebase, i.e.\n")
 	fmt.Printf("    to behave as if 'override default' was specified.  Additionally, comments\n")
-	fmt.Printf("    (starting with #) and blank lines in the rebase todo file are passed\n")
-	fmt.Printf("    through verbatim. Quick note: you must write-new and swap, not\n")
-	fmt.Printf("    overwrite the initial rebase todo file (for now).\n")
+	fmt.Printf("    (starting with #), blank lines and noop lines in the rebase todo file are\n")
+	fmt.Printf("    passed through verbatim. exec and break lines already in the rebase todo\n")
+	fmt.Printf("    file are never changed by any instruction, 'default' included. Those\n")
+	fmt.Printf("    straight after a commit stay attached to it, and move with it. Those\n")
+	fmt.Printf("    after a comment or blank line stay where they are.\n")
+	fmt.Printf("\n")
+	fmt.Printf("    Todo files written by --rebase-merges are understood. label and reset\n")
+	fmt.Printf("    lines are passed through and stay where they are. A merge line naming a\n")
+	fmt.Printf("    commit with -C or -c can be targeted by its hash: pick keeps its message\n")
+	fmt.Printf("    (-C), reword edits it (-c), drop drops it, and breaks and execs are added\n")
+	fmt.Printf("    after it. Merges can't be folded or moved. label, reset and merge are not\n")
+	fmt.Printf("    valid as instructions.\n")
+	fmt.Printf("\n")
+	fmt.Printf("    update-ref lines (from --update-refs) work the same way, unless the\n")
+	fmt.Printf("    commit is folded into one somewhere else. Then they stay with the commit\n")
+	fmt.Printf("    before it. Two extra instructions manage them:\n")
+	fmt.Printf("        update-ref [COMMIT-ID] [REF]   update REF after COMMIT-ID, removing\n")
+	fmt.Printf("                                       any update-ref line for REF already\n")
+	fmt.Printf("                                       in the todo file.\n")
+	fmt.Printf("        drop-ref [REF]                 remove the update-ref line for REF.\n")
+	fmt.Printf("    REF may be a branch name or a full ref name starting with refs/.\n")
+	fmt.Printf("\n")
+	fmt.Printf("    The extra commands {bubble, u} and {sink, k} pick a commit, but move it\n")
+	fmt.Printf("    to the end of the todo file (the top of the history). Sunk commits go\n")
+	fmt.Printf("    after everything else, bubbled commits included, so they suit things\n")
+	fmt.Printf("    like reverts of debug logging and release bumps. Bubbled and sunk\n")
+	fmt.Printf("    commits keep their original order relative to one another, and take their\n")
+	fmt.Printf("    fixups and squashes with them.\n")
+	fmt.Printf("\n")
+	fmt.Printf("    Commits can be moved anywhere with:\n")
+	fmt.Printf("        move [COMMIT-ID] after [OTHER-COMMIT-ID]\n")
+	fmt.Printf("        move [COMMIT-ID] before [OTHER-COMMIT-ID]\n")
+	fmt.Printf("    The fixups and squashes which follow the commit, and its break, exec and\n")
+	fmt.Printf("    update-ref lines, move along with it. 'after' places it after the other\n")
+	fmt.Printf("    commit's own fixups and squashes, and 'before' places it before the\n")
+	fmt.Printf("    commit they belong to, so it never lands inside them. Moves happen once\n")
+	fmt.Printf("    everything else is done, in the order they are given, and don't change\n")
+	fmt.Printf("    the commit's command.\n")
 }
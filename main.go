@@ -1,156 +1,165 @@
 package main
 
 import (
-	"bufio"
+	"bytes"
+	"flag"
 	"fmt"
+	"io"
 	"os"
-	"unicode"
-)
-
-type command string
-type trailer interface {
-	command() string
-}
+	"path/filepath"
 
-type break_trailer struct {}
-func (t break_trailer) command() string { return "break" }
+	"github.com/thewug/rebase-respin/respin"
+)
 
-type exec_trailer struct {
-	cmd string
+// fail_to_parse_args complains and exits the program if called.
+func die(format string, objs ...interface{}) {
+	println(fmt.Sprintf(format, objs...))
+	os.Exit(1)
 }
-func (t exec_trailer) command() string { return fmt.Sprintf("exec %s", t.cmd) }
 
-type reaction struct {
-	mode command
-	extra string
-	auxiliary []trailer
-}
+// replaceFile atomically replaces the file at path with whatever write produces.
+// the new contents go to a temporary file in the same directory which is then renamed
+// over the original, so git never gets to see a half-written todo file.
+func replaceFile(path string, write func(io.Writer) error) error {
+	info, err := os.Stat(path)
+	if err != nil { return err }
 
-type output_node struct {
-	next, prev *output_node
-	line string
-	msg string
-	trailers []trailer
-}
+	tmp, err := os.CreateTemp(filepath.Dir(path), "." + filepath.Base(path) + ".*")
+	if err != nil { return err }
+	defer os.Remove(tmp.Name())
 
-func newList() (*output_node, *output_node) {
-	head, tail := &output_node{}, &output_node{}
-	head.next, tail.prev = tail, head
-	return head, tail
-}
+	err = write(tmp)
+	if err == nil { err = tmp.Chmod(info.Mode().Perm()) }
+	if err == nil { err = tmp.Sync() }
+	if e := tmp.Close(); err == nil { err = e }
+	if err != nil { return err }
 
-func (this *output_node) insert_after(n *output_node) {
-	next := this.next
-	next.prev, this.next = n, n
-	n.prev, n.next = this, next
+	return os.Rename(tmp.Name(), path)
 }
 
-var commands = map[string]command{
-	// these are commands provided by git.
-	"pick":   "pick",
-	"p":      "pick",
-	"reword": "reword",
-	"r":      "reword",
-	"edit":   "edit",
-	"e":      "edit",
-	"squash": "squash",
-	"s":      "squash",
-	"fixup":  "fixup",
-	"f":      "fixup",
-	"drop":   "drop",
-	"d":      "drop",
-	"exec":   "exec",
-	"x":      "exec",
-	"break":  "break",
-	"b":      "break",
-	"override": "",
-	"o":        "",
-	"label":    "",
-	"l":        "",
-	"reset":    "",
-	"t":        "",
-	"merge":    "",
-	"m":        "",
-	"":         "",
-
-	// these are extra commands provided by rebase-respin that git rebase isn't aware of.
-	"bubble":   "bubble",
-	"u":        "bubble",
-}
+func main() {
+	instructions := flag.String("instructions", "", "")
+	dry_run := flag.Bool("dry-run", false, "")
+	format := flag.String("format", "lines", "")
+	strict := flag.Bool("strict", false, "")
+	conflicts := flag.String("conflicts", "last-wins", "")
+	orphans := flag.String("orphans", "error", "")
+	instruction_format := flag.String("instruction-format", "", "")
+	comment_char := flag.String("comment-char", "", "")
+	style := flag.String("style", "preserve", "")
+	flag.Usage = showUsage
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		die("Unexpected arguments: only wanted 1, got %d", flag.NArg())
+	}
+	todo_path := flag.Arg(0)
+
+	// instructions come from stdin unless a file is named, in which case stdin is left alone
+	// and the todo file is rewritten in place, which is what git expects of GIT_SEQUENCE_EDITOR.
+	settings := os.Stdin
+	if *instructions != "" {
+		var err error
+		settings, err = os.Open(*instructions)
+		if err != nil { die("Error opening \"%s\" for read: %s", *instructions, err) }
+		defer settings.Close()
+	}
 
-// grab one token off the front of a string.
-// token boundaries are whitespace.
-// whitespace is trimmed from the remainder string.
-// if there is no suitable token, an empty string is returned ad infinitum.
-func grab(s string) (string, string) {
-	var i int
-	var r rune
-	var end bool
-	end = true
-	for i, r = range s {
-		if !unicode.IsSpace(r) {
-			end = false
-			break
-		}
+	original, err := os.ReadFile(todo_path)
+	if err != nil { die("Error opening \"%s\" for read: %s", todo_path, err) }
+
+	plan := respin.NewPlan()
+	plan.File = *instructions
+	if plan.File == "" { plan.File = "<stdin>" }
+	plan.Resolve = respin.RevParse
+	switch *conflicts {
+	case "last-wins":
+		plan.OnConflict = respin.LastWins
+	case "first-wins":
+		plan.OnConflict = respin.FirstWins
+	case "error":
+		plan.OnConflict = respin.FailOnConflict
+	default:
+		die("Unknown conflict policy: %s (expected last-wins, first-wins or error)", *conflicts)
 	}
-	if end { i = len(s) }
-	s = s[i:]
-
-	end = true
-	for i, r = range s {
-		if unicode.IsSpace(r) {
-			end = false
-			break
-		}
+	switch *orphans {
+	case "error":
+		plan.OnOrphan = respin.OrphanError
+	case "leave":
+		plan.OnOrphan = respin.OrphanLeave
+	case "drop":
+		plan.OnOrphan = respin.OrphanDrop
+	case "pick":
+		plan.OnOrphan = respin.OrphanPick
+	default:
+		die("Unknown orphan policy: %s (expected error, leave, drop or pick)", *orphans)
 	}
-	if end { i = len(s) }
-	out := s[:i]
-	s = s[i:]
-
-	end = true
-	for i, r = range s {
-		if !unicode.IsSpace(r) {
-			end = false
-			break
-		}
+	switch *style {
+	case "preserve":
+		plan.Style = respin.PreserveCommands
+	case "long":
+		plan.Style = respin.LongCommands
+	case "short":
+		plan.Style = respin.ShortCommands
+	default:
+		die("Unknown command style: %s (expected preserve, long or short)", *style)
 	}
-	if end { i = len(s) }
-	s = s[i:]
-
-	return out, s
-}
-
-// fail_to_parse_args complains and exits the program if called.
-func die(format string, objs ...interface{}) {
-	println(fmt.Sprintf(format, objs...))
-	os.Exit(1)
-}
-
-func main() {
-	if len(os.Args) != 2 {
-		die("Unexpected arguments: only wanted 1, got %d", len(os.Args) - 1)
+	switch *format {
+	case "lines":
+		err = plan.Read(settings)
+	case "json":
+		err = plan.ReadJSON(settings)
+	default:
+		die("Unknown instruction format: %s (expected lines or json)", *format)
 	}
-
-	if os.Args[1] == "-h" || os.Args[1] == "--help" {
-		showUsage()
-		os.Exit(0)
+	if err != nil { die("%s", err) }
+	for _, c := range plan.Conflicts() {
+		// the conflict is the fault of whichever instruction came second.
+		later := c.Dropped
+		if plan.OnConflict == respin.LastWins { later = c.Kept }
+		fmt.Fprintf(os.Stderr, "%s: warning: %s\n", later.Pos, c)
 	}
 
-	rebase_todo, err := os.Open(os.Args[1])
-	if err != nil { die("Error opening \"%s\" for read: %s", os.Args[1], err) }
+	todo, err := respin.Parse(bytes.NewReader(original))
+	if err != nil { die("%s", err) }
+	todo.File = todo_path
 
-	config := make(map[string]reaction)
+	// subjects are pulled out of the todo the way git wrote them, which is up to git config.
+	todo.InstructionFormat = *instruction_format
+	if todo.InstructionFormat == "" {
+		todo.InstructionFormat, err = respin.ConfiguredInstructionFormat()
+		if err != nil { die("Error reading rebase.instructionFormat: %s", err) }
+	}
+	todo.CommentChar = *comment_char
+	if todo.CommentChar == "" {
+		todo.CommentChar, err = respin.ConfiguredCommentChar()
+		if err != nil { die("Error reading core.commentChar: %s", err) }
+	}
 
-	config, err = readSettings(config, bufio.NewScanner(os.Stdin))
+	res, err := respin.Apply(plan, todo)
 	if err != nil { die("%s", err) }
+	out := res.Todo
 
-	head, tail, err := parseInput(config, bufio.NewScanner(rebase_todo))
-	if err != nil { die("%s", err) }
+	for _, i := range res.Unmatched {
+		fmt.Fprintf(os.Stderr, "%s: warning: %s didn't match anything in the rebase todo\n", i.Pos, i)
+	}
+	for _, w := range res.Warnings {
+		fmt.Fprintf(os.Stderr, "%s: warning: %s\n", w.Position, w.Msg)
+	}
+	if *strict && len(res.Unmatched) != 0 {
+		die("Giving up: %d instructions didn't match anything (--strict)", len(res.Unmatched))
+	}
+
+	if *dry_run {
+		respin.Diff(os.Stdout, todo_path, todo_path, todo, out)
+		fmt.Fprintln(os.Stderr, respin.Summarize(todo, out))
+		return
+	}
 
-	for node := tail.prev; node != head; node = node.prev {
-		fmt.Println(node.line)
-		for _, t := range node.trailers {
-			fmt.Println(t.command())
-		}
+	if *instructions == "" {
+		err = respin.Format(os.Stdout, out)
+	} else {
+		err = replaceFile(todo_path, func(w io.Writer) error { return respin.Format(w, out) })
 	}
+	if err != nil { die("Error writing rebase todo: %s", err) }
 }
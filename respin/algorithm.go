@@ -0,0 +1,709 @@
+package respin
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+func push(s string, head *output_node) {
+	head.insert_after(&output_node{line: s})
+}
+
+func strip_fixup_squash(msg string) string {
+	for {
+		token, new_msg := grab(msg)
+		if token != "fixup!" && token != "squash!" && token != "amend!" { break }
+		msg = new_msg
+	}
+	return msg
+}
+
+// fixup_targets lists the subjects that a commit with the given subject is a fixup of, nearest
+// first: "fixup! squash! foo" fixes up "squash! foo", and failing that, "foo".
+func fixup_targets(msg string) []string {
+	var out []string
+	for {
+		token, new_msg := grab(msg)
+		if token != "fixup!" && token != "squash!" && token != "amend!" { return out }
+		msg = new_msg
+		out = append(out, msg)
+	}
+}
+
+// index_subject makes node the latest commit with the subject msg, and also with every subject
+// it is a fixup of, so that later fixups of any of them go after it.
+func index_subject(node *output_node, msg string, commits_by_message map[string]*output_node) {
+	commits_by_message[msg] = node
+	for _, target := range fixup_targets(msg) { commits_by_message[target] = node }
+}
+
+// autosquash_command works out the command git's autosquash would give a commit with the given
+// subject, going by its outermost prefix. it is empty for commits which aren't fixups at all.
+func autosquash_command(msg string) command {
+	token, _ := grab(msg)
+	switch token {
+	case "fixup!": return commands["fixup"]
+	case "squash!": return commands["squash"]
+	case "amend!": return commands["fixup-C"]
+	}
+	return commands["override"]
+}
+
+func push_commit(s, msg, hash string, t []trailer, head *output_node, commits_by_message, commits_by_hash map[string]*output_node) *output_node {
+	node := &output_node{line: s, msg: msg, trailers: t}
+	index_subject(node, msg, commits_by_message)
+	commits_by_hash[hash] = node
+	head.insert_after(node)
+	return head
+}
+
+// waiting_list holds the commits being folded into a commit which comes later in the todo,
+// until it turns up. pos is where the first of them was, for diagnostics.
+type waiting_list struct {
+	head, tail *output_node
+	pos Position
+}
+
+// orphan_error is what relocate_commit fails with when a fixup's subject names a commit which
+// isn't in the todo, usually because it was committed before the start of the rebase. target is
+// empty for a fixup with nothing before it to fold into.
+type orphan_error struct {
+	target string
+}
+
+func (e *orphan_error) Error() string {
+	if e.target == "" { return "Can't apply fixup (there is no commit before it)" }
+	return fmt.Sprintf("Can't apply fixup (subject commit is missing: %s)", e.target)
+}
+
+func relocate_commit(s, msg, hash, after string, t []trailer, head *output_node, commits_by_message, commits_by_hash map[string]*output_node) (*output_node, error) {
+	orig_msg := msg
+	msg = strip_fixup_squash(msg)
+
+	// found is the commit a fixup was aimed at by its subject, and groups are the subjects whose
+	// fixups might have ended with it.
+	var found *output_node
+	var groups []string
+
+	if after != "" {
+		// if after is specified, use it to look up a new commit to attach to with precedence over all other methods.
+		var ok bool
+		head, ok = commits_by_hash[after]
+		if !ok { head, ok = commits_by_message[after] }
+		if !ok { return nil, fmt.Errorf("Can't apply fixup (subject commit is missing: %s)", after) }
+		head = head.prev
+	} else if orig_msg != msg {
+		// if it is a fixup commit, look up the commit to apply it to by commit message.
+		// it is an error to try to process a fixup which attaches to a commit outside the scope of the rebase.
+		// the prefixes are taken off one at a time, so a fixup of a fixup goes right after the fixup it amends.
+		// like git, a subject which doesn't match anything may be the hash of the commit instead.
+		var ok bool
+		for _, target := range fixup_targets(orig_msg) {
+			if found, ok = commits_by_message[target]; ok {
+				groups = append([]string{target}, fixup_targets(target)...)
+				break
+			}
+		}
+		if !ok && !strings.ContainsAny(msg, " \t") {
+			if found, ok = lookup_hash(commits_by_hash, msg); ok { groups = append([]string{msg, found.msg}, fixup_targets(found.msg)...) }
+		}
+		if !ok { return nil, &orphan_error{target: msg} }
+		head = found.prev
+	} else {
+		// this isn't a designated fixup commit, so just apply it to the head.
+		// in this case, head is already correct (as passed by the caller), unless there's nothing
+		// before it at all.
+		if head == nil { return nil, &orphan_error{} }
+	}
+
+	node := &output_node{line: s, msg: orig_msg, trailers: t}
+	head.insert_after(node)
+
+	if found == nil {
+		index_subject(node, orig_msg, commits_by_message)
+	} else {
+		// the fixup now ends the group of fixups it joined, and any bigger group which ended in the
+		// same place. groups which end further on are left alone, so a fixup of a fixup doesn't
+		// drag later fixups of the original commit in after it.
+		for _, g := range groups {
+			if end, ok := commits_by_message[g]; !ok || end == found { commits_by_message[g] = node }
+		}
+		commits_by_message[orig_msg] = node
+	}
+	commits_by_hash[hash] = node
+
+	return head, nil
+}
+
+// lookup_hash finds the commit named by hash, which may be longer or shorter than the hash the
+// todo has for it, so long as it doesn't fit any other commit too.
+func lookup_hash(commits_by_hash map[string]*output_node, hash string) (*output_node, bool) {
+	if node, ok := commits_by_hash[hash]; ok { return node, true }
+	if !is_hash(hash) { return nil, false }
+
+	var found *output_node
+	for h, node := range commits_by_hash {
+		if !same_commit(h, hash) { continue }
+		if found != nil { return nil, false }
+		found = node
+	}
+	return found, found != nil
+}
+
+// react works out what should happen to the commit with the given hash and subject. it starts
+// with the default settings, then overrides them with those of every matching selector in the
+// order they were given, and finally with those for the exact hash, if there are any. ones which
+// only add trailers don't change the command.
+// the tracker is passed to the range selectors, so commits must be reacted to in todo order.
+func react(p *Plan, tr *tracker, hash, subject string) (reaction, bool) {
+	var specifics []reaction
+	for _, s := range p.selectors {
+		if s.matches(tr.ranges, hash, subject) {
+			specifics = append(specifics, p.config[s.key])
+			tr.used[s.key] = true
+		}
+	}
+	if specific_reaction, ok := p.config[hash]; ok {
+		specifics = append(specifics, specific_reaction)
+		tr.used[hash] = true
+	}
+
+	r := p.config["default"]
+	for _, specific_reaction := range specifics {
+		r.auxiliary = append(append([]trailer(nil), r.auxiliary...), specific_reaction.auxiliary...)
+		if specific_reaction.mode == commands["override"] && !specific_reaction.keep { continue }
+		r.mode = specific_reaction.mode
+		r.extra = specific_reaction.extra
+	}
+	return r, len(specifics) != 0
+}
+
+// push_merge handles a merge line from a --rebase-merges todo file.
+// a merge which takes its message from a commit (with -C or -c) can be targeted by instructions,
+// but it can't be folded into anything or moved, since that would tear up the labels around it.
+func push_merge(raw_line, line string, p *Plan, tr *tracker, sp spelling, head *output_node, commits_by_message, commits_by_hash map[string]*output_node) (*output_node, error) {
+	token, remainder := grab(line)
+	flag, remainder := grab(remainder)
+	orig_flag := flag
+	if flag != "-C" && flag != "-c" {
+		// there's no commit to key on, so just repeat it verbatim.
+		push(sp.line(raw_line), head)
+		return head, nil
+	}
+
+	hash, remainder := grab(remainder)
+	msg := ""
+	if i := strings.Index(remainder, "#"); i != -1 { msg = strings.TrimSpace(remainder[i+1:]) }
+
+	r, ok := react(p, tr, hash, msg)
+	var out string
+	switch r.mode {
+	case commands["override"]:
+	case commands["pick"]:
+		flag = "-C"
+	case commands["reword"]:
+		flag = "-c"
+	case commands["drop"]:
+		out = fmt.Sprintf("%s %s %s", sp.command(commands["drop"]), hash, remainder)
+	default:
+		// the default reaction is allowed to not make sense for merges, but a specific one isn't.
+		if ok { return nil, fmt.Errorf("Can't %s a merge commit: %s", r.mode, hash) }
+	}
+	if out == "" { out = fmt.Sprintf("%s %s %s %s", sp.keep(token, commands["merge"], commands["merge"]), flag, hash, remainder) }
+	if out == fmt.Sprintf("%s %s %s %s", token, orig_flag, hash, remainder) { out = raw_line }
+
+	node := &output_node{line: out, msg: msg, trailers: r.auxiliary}
+	commits_by_message[msg] = node
+	commits_by_hash[hash] = node
+	head.insert_after(node)
+	return head, nil
+}
+
+// group_end finds the last node of the group led by n, which is n and any fixups and squashes
+// after it, in todo order. the list is kept backwards, so they come before it.
+func group_end(n *output_node, comment string) *output_node {
+	for {
+		mode, _, ok := todo_commit(strings.TrimSpace(n.prev.line), comment)
+		if !ok || !folds(mode) { return n }
+		n = n.prev
+	}
+}
+
+// group_start finds the commit leading the group n is in, which is n unless it is a fixup or
+// squash, in todo order. the list is kept backwards, so it comes after them.
+func group_start(n *output_node, comment string) *output_node {
+	for n.next.next != nil {
+		mode, _, ok := todo_commit(strings.TrimSpace(n.line), comment)
+		if !ok || !folds(mode) { return n }
+		n = n.next
+	}
+	return n
+}
+
+// apply_move carries out a move instruction on a finished list. the commit being moved takes
+// its fixups, squashes, and trailers with it. it never goes inside another commit's group, so
+// moving a commit before a fixup puts it before the commit the fixup belongs to.
+func apply_move(m move, commits_by_hash map[string]*output_node, comment string) error {
+	where := "before"
+	if m.after { where = "after" }
+
+	node, ok := commits_by_hash[m.hash]
+	if !ok { return fmt.Errorf("Can't move %s %s %s (commit is missing: %s)", m.hash, where, m.target, m.hash) }
+	target, ok := commits_by_hash[m.target]
+	if !ok { return fmt.Errorf("Can't move %s %s %s (commit is missing: %s)", m.hash, where, m.target, m.target) }
+
+	if mode, _, _ := todo_commit(node.line, comment); strings.HasPrefix(string(mode), string(commands["merge"])) {
+		return fmt.Errorf("Can't move %s %s %s (merges can't be moved)", m.hash, where, m.target)
+	}
+
+	end := group_end(node, comment)
+	for n := node; n != end.prev; n = n.prev {
+		if n == target { return fmt.Errorf("Can't move %s %s %s, which moves along with it", m.hash, where, m.target) }
+	}
+
+	unlink(end, node)
+	if m.after {
+		group_end(target, comment).prev.splice_after(end, node)
+	} else {
+		group_start(target, comment).splice_after(end, node)
+	}
+	return nil
+}
+
+// tracker keeps track of what a plan has done so far, while it is applied to a todo.
+type tracker struct {
+	// how far through each range selector the todo has got.
+	ranges map[*selector]int
+	// which hashes and selectors have matched something.
+	used map[string]bool
+	// problems which aren't bad enough to stop the todo being rewritten.
+	warnings Diagnostics
+}
+
+func new_tracker() *tracker {
+	return &tracker{ranges: make(map[*selector]int), used: make(map[string]bool)}
+}
+
+// typical implementer is bufio.Scanner
+type myscanner interface {
+	Scan() bool
+	Text() string
+}
+
+// decide checks an instruction against the one which already decided key, if there is one. if
+// they don't agree, the conflict is dealt with the way the plan says. it reports whether the
+// instruction should be used.
+func decide(p *Plan, key string, i Instruction, agrees func(other Instruction) bool) (bool, error) {
+	other, ok := p.decided[key]
+	if !ok {
+		p.decided[key] = i
+		return true, nil
+	}
+	if agrees(other) { return true, nil }
+
+	switch p.OnConflict {
+	case FailOnConflict:
+		return false, fmt.Errorf("%s conflicts with %s", i, other.located())
+	case FirstWins:
+		p.conflicts = append(p.conflicts, Conflict{Kept: other, Dropped: i})
+		return false, nil
+	}
+	p.conflicts = append(p.conflicts, Conflict{Kept: i, Dropped: other})
+	p.decided[key] = i
+	return true, nil
+}
+
+// instruct applies a single instruction to a plan. errors about a particular part of the
+// instruction are blamed on it, so that readSettings can point at it.
+func instruct(p *Plan, i Instruction) error {
+	token, hash, args := i.Action, i.Commit, i.Args
+
+	// barf if we don't recognize the command
+	mode, ok := commands[token]
+	if !ok { return fmt.Errorf("Got a junk rebase command: %s", token) }
+	if mode == commands["label"] || mode == commands["reset"] || mode == commands["merge"] || mode == commands["noop"] {
+		return fmt.Errorf("Can't use %s as an instruction, it only belongs in a rebase todo file", token)
+	}
+
+	// barf if the hash is empty
+	if len(hash) == 0 { return blame(in_commit, "Missing hash string") }
+
+	// moves don't change what happens to the commit, only where it goes.
+	if mode == commands["move"] {
+		direction, rest := grab(args)
+		target, _ := grab(rest)
+		if direction != "after" && direction != "before" { return blame(in_args, "Expected after or before, got '%s'", direction) }
+		if len(target) == 0 { return blame(in_args, "Missing hash string to move %s", direction) }
+		if hash == "default" || target == "default" { return blame(in_commit, "Can't move default") }
+		if hash == target { return blame(in_args, "Can't move %s %s itself", hash, direction) }
+
+		// two moves of the same commit which disagree about where it goes conflict.
+		use, err := decide(p, "move " + hash, i, func(other Instruction) bool {
+			other_direction, rest := grab(other.Args)
+			other_target, _ := grab(rest)
+			return other_direction == direction && other_target == target
+		})
+		if err != nil { return err }
+		if use {
+			for j, m := range p.moves {
+				if m.hash == hash { p.moves = append(p.moves[:j], p.moves[j + 1:]...); break }
+			}
+			p.moves = append(p.moves, move{hash: hash, after: direction == "after", target: target, pos: i.Pos})
+		}
+		p.instructions = append(p.instructions, i)
+		return nil
+	}
+
+	// drop-ref names a ref rather than a commit.
+	if mode == commands["drop-ref"] { hash = normalize_ref(hash) }
+	i.Commit = hash
+
+	// subject selectors are kept in order, so that the later ones take precedence.
+	sel, err := parse_selector(hash)
+	if err != nil { return &blamed_error{in: in_commit, err: err} }
+	if sel != nil {
+		if mode == commands["update-ref"] { return blame(in_commit, "Can't use %s with a subject selector", token) }
+		sel.pos = i.Pos
+		if _, ok := p.config[hash]; !ok { p.selectors = append(p.selectors, sel) }
+	}
+
+	// look up the reaction for this hash and modify it.
+	r := p.config[hash]
+	if mode == commands["break"] {
+		r.auxiliary = append(r.auxiliary, break_trailer{})
+	} else if mode == commands["exec"] {
+		r.auxiliary = append(r.auxiliary, exec_trailer{cmd: args})
+	} else if mode == commands["update-ref"] {
+		ref, _ := grab(args)
+		if len(ref) == 0 { return blame(in_args, "Missing ref name") }
+		ref = normalize_ref(ref)
+		if hash == "default" { return blame(in_commit, "Can't put %s after every commit", ref) }
+
+		// a ref can only be updated once per rebase.
+		if other, ok := p.refs[ref]; ok { return blame(in_args, "Ref %s is already placed by %s", ref, other.located()) }
+		p.refs[ref] = i
+
+		r.auxiliary = append(r.auxiliary, update_ref_trailer{ref: ref})
+	} else {
+		// two instructions which disagree about what to do with the same commit conflict.
+		use, err := decide(p, hash, i, func(other Instruction) bool { return commands[other.Action] == mode && other.Args == args })
+		if err != nil { return err }
+		if !use {
+			p.instructions = append(p.instructions, i)
+			return nil
+		}
+
+		r.mode = mode
+		r.extra = args
+		r.keep = mode == commands["override"]
+	}
+	p.config[hash] = r
+	p.instructions = append(p.instructions, i)
+	return nil
+}
+
+// readSettings reads instructions, one per line, into a plan. it carries on past bad
+// instructions, and returns a diagnostic for every one of them.
+func readSettings(p *Plan, scanner myscanner) error {
+	var diags Diagnostics
+	var n int
+	for scanner.Scan() {
+		n++
+		raw_line := scanner.Text()
+		line := strings.TrimSpace(raw_line)
+
+		// discard blank lines
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		// every part of the line is a suffix of it, which is how their columns are found.
+		end := len(strings.TrimRightFunc(raw_line, unicode.IsSpace))
+		col := func(suffix string) int { return end - len(suffix) + 1 }
+
+		token, rest := grab(line)
+		hash, args := grab_selector(rest)
+		i := Instruction{Action: token, Commit: hash, Args: args}
+		i.Pos = Position{File: p.File, Line: n, Col: col(line)}
+		diagnose := func(err error) *Diagnostic {
+			d := &Diagnostic{Position: i.Pos, Text: token, Msg: err.Error()}
+			if b, ok := err.(*blamed_error); ok && b.in == in_commit {
+				d.Col, d.Text = col(rest), hash
+			} else if ok && b.in == in_args {
+				d.Col, d.Text = col(args), args
+			}
+			return d
+		}
+		p.diagnose[i] = diagnose
+		if err := instruct(p, i); err != nil { diags = append(diags, diagnose(err)) }
+	}
+
+	return diags.err()
+}
+
+func parseInput(p *Plan, tr *tracker, t *Todo) (*output_node, *output_node, error) {
+	config := p.config
+	file, format, comment := t.File, compile_format(t.InstructionFormat), t.comment()
+	sp := new_spelling(p.Style, t, comment)
+	scanner := &line_scanner{lines: t.Lines}
+	var diags Diagnostics
+	var n int
+	bubble_head, bubble_tail := newList()
+	sink_head, sink_tail := newList()
+	head, tail := newList()
+	var last, last_commit *output_node
+
+	// update-ref lines stick to ref_commit, which is last_commit unless that was folded into a
+	// commit somewhere else. a ref left on the fold would go with it and lose what came in between.
+	var ref_commit *output_node
+
+	commits_by_message := make(map[string]*output_node)
+	commits_by_hash := make(map[string]*output_node)
+
+	// every commit seen so far with each subject, in todo order, to spot ambiguous fixups with.
+	subjects := make(map[string][]string)
+
+	// the todo is read in two passes. the first finds every commit in it, so that the second can
+	// fold commits into ones which come after them.
+	var lines []string
+	ahead := make(map[string]bool)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+		if _, hash, ok := todo_commit(strings.TrimSpace(scanner.Text()), comment); ok { ahead[hash] = true }
+	}
+	waiting := make(map[string]*waiting_list)
+	var waiting_for []string
+
+	// refs which the instructions put after a commit in the todo have their old update-ref lines
+	// removed. refs put after a commit which isn't there stay where they were.
+	placed_refs := make(map[string]bool)
+	for hash, r := range config {
+		if !ahead[hash] { continue }
+		for _, t := range r.auxiliary {
+			if u, ok := t.(update_ref_trailer); ok { placed_refs[u.ref] = true }
+		}
+	}
+
+	for _, raw_line := range lines {
+		n++
+		line := strings.TrimSpace(raw_line)
+
+		// problems with a line point at its command, and don't stop the rest of the todo being read.
+		pos := Position{File: file, Line: n, Col: strings.Index(raw_line, line) + 1}
+		fail := func(e error) {
+			diags = append(diags, &Diagnostic{Position: pos, Text: raw_line, Msg: e.Error()})
+			push(raw_line, head)
+			last, last_commit = head, head.next
+			ref_commit = last_commit
+		}
+
+		// grab 2 tokens from the input
+		kind, mode := classify(line, comment)
+		token, remainder := grab(line)
+		hash, remainder := grab(remainder)
+
+		switch kind {
+		case verbatim_line:
+			// blank lines, comments, and anything we don't recognize get passed through verbatim.
+			// riders after one stay where they are, rather than jumping over it to the commit.
+			push(raw_line, head)
+			last_commit, ref_commit = nil, nil
+			continue
+
+		case anchor_line:
+			// label and reset lines give a --rebase-merges todo its shape, so they are passed through
+			// untouched, and nothing after them is allowed to attach itself to what came before. a
+			// fold straight after one has no commit before it to fold into.
+			push(sp.line(raw_line), head)
+			last, last_commit, ref_commit = nil, nil, nil
+			continue
+
+		case rider_line:
+			// exec and break lines straight after a commit stick to it, wherever it goes, exactly as
+			// they were written. they aren't commits, so no instruction changes them.
+			if last_commit == nil {
+				push(sp.line(raw_line), head)
+			} else {
+				last_commit.trailers = append(append([]trailer(nil), last_commit.trailers...), kept_trailer{line: raw_line})
+			}
+			continue
+
+		case ref_line:
+			// update-ref lines straight after a commit stick to it too, unless they're dropped or
+			// placed, and are kept as they were written.
+			ref := hash
+			if config[ref].mode == commands["drop-ref"] {
+				tr.used[ref] = true
+				continue
+			} else if placed_refs[ref] {
+				continue
+			} else if ref_commit == nil {
+				push(sp.line(raw_line), head)
+			} else {
+				ref_commit.trailers = append(append([]trailer(nil), ref_commit.trailers...), update_ref_trailer{ref: ref, line: raw_line})
+			}
+			continue
+
+		case merge_line:
+			var e error
+			last, e = push_merge(raw_line, line, p, tr, sp, head, commits_by_message, commits_by_hash)
+			if e != nil { fail(e); continue }
+			last_commit, ref_commit = last.next, last.next
+			continue
+		}
+
+		// fixup takes an option saying which commit message to keep, before the hash.
+		if mode == commands["fixup"] && (hash == "-C" || hash == "-c") {
+			mode = commands["fixup" + hash]
+			token = token + " " + hash
+			hash, remainder = grab(remainder)
+		}
+
+		// commands are written the way the plan says, which may be the way they already were. lines
+		// which come out the same are kept exactly as they were, whitespace and all.
+		text := func(m command) string {
+			if out := fmt.Sprintf("%s %s %s", sp.keep(token, mode, m), hash, remainder); out != fmt.Sprintf("%s %s %s", token, hash, remainder) { return out }
+			return raw_line
+		}
+
+		// the rest of the line is the subject, unless rebase.instructionFormat put more there.
+		// the line keeps everything, but only the subject is matched against.
+		subject := format.subject(remainder)
+
+		// look up the reaction to this hash
+		r, _ := react(p, tr, hash, subject)
+
+		// autosquash picks the command from the commit's subject.
+		if r.mode == commands["autosquash"] { r.mode = autosquash_command(subject) }
+
+		// amend! commits replace the message of the commit they fix up, so like git's autosquash,
+		// they become fixup -C rather than plain fixups.
+		if r.mode == commands["fixup"] && strings.HasPrefix(subject, "amend! ") {
+			r.mode = commands["fixup-C"]
+		}
+
+		// override is special, it means "keep the line verbatim", so grab the command from the line
+		if r.mode == commands["override"] {
+			r.mode = command(mode)
+		}
+
+		relocated := false
+		if folds(r.mode) {
+			var e error
+			if folds(mode) && len(r.extra) == 0 {
+				// if the command came in as a fixup/squash, and is configured to remain a fixup/squash, then
+				// it should remain bound to the commit it was originally attached to if that commit moves.
+				// there may not be one, if it's the first commit in the todo.
+				if last == nil {
+					e = &orphan_error{}
+				} else {
+					// update-ref lines the todo already had in front of it stay in front of it.
+					if ref_commit != nil && ref_commit == last_commit {
+						for j, t := range ref_commit.trailers {
+							if u, ok := t.(update_ref_trailer); ok && u.line != "" {
+								u.pinned = true
+								ref_commit.trailers[j] = u
+							}
+						}
+					}
+					last = push_commit(text(r.mode), subject, hash, r.auxiliary, last, commits_by_message, commits_by_hash)
+				}
+			} else {
+				// if we are converting it into a fixup/squash, then relocate it. a fixup! subject goes
+				// to the nearest commit before it with that subject, but say so if there was a choice.
+				var target_subject string
+				for _, target := range fixup_targets(subject) {
+					if _, ok := commits_by_message[target]; ok { target_subject = target; break }
+				}
+				if candidates := subjects[target_subject]; len(r.extra) == 0 && len(candidates) > 1 {
+					msg := fmt.Sprintf("Ambiguous %s: %s could belong to any of %s, which are all titled %q; using %s, the nearest one before it",
+						r.mode, hash, strings.Join(candidates, ", "), target_subject, candidates[len(candidates) - 1])
+					tr.warnings = append(tr.warnings, &Diagnostic{Position: pos, Text: raw_line, Msg: msg})
+				}
+
+				// commits folded into one further on wait in a list of their own until it turns up.
+				if ahead[r.extra] && r.extra != hash && commits_by_hash[r.extra] == nil && commits_by_message[r.extra] == nil {
+					w, ok := waiting[r.extra]
+					if !ok {
+						w = &waiting_list{pos: pos}
+						w.head, w.tail = newList()
+						waiting[r.extra], waiting_for = w, append(waiting_for, r.extra)
+					}
+					last = push_commit(text(r.mode), subject, hash, r.auxiliary, w.head, commits_by_message, commits_by_hash)
+					last_commit = last.next
+					subjects[subject] = append(subjects[subject], hash)
+					continue
+				}
+
+				last, e = relocate_commit(text(r.mode), subject, hash, r.extra, r.auxiliary, last, commits_by_message, commits_by_hash)
+				relocated = e == nil
+			}
+			if o, ok := e.(*orphan_error); ok && p.OnOrphan != OrphanError {
+				// fixups of commits from before the rebase are dealt with as the plan says, and
+				// reported either way.
+				orphan_mode, what := command(mode), "leaving it as it was"
+				if p.OnOrphan == OrphanDrop {
+					orphan_mode, what = commands["drop"], "dropping it"
+				} else if p.OnOrphan == OrphanPick {
+					orphan_mode, what = commands["pick"], "picking it instead"
+				}
+				msg := fmt.Sprintf("%s %s is a fixup of %s, which isn't in the todo; %s", r.mode, hash, o.target, what)
+				if o.target == "" { msg = fmt.Sprintf("%s %s has no commit before it to fold into; %s", r.mode, hash, what) }
+				tr.warnings = append(tr.warnings, &Diagnostic{Position: pos, Text: raw_line, Msg: msg})
+				last, e = push_commit(text(orphan_mode), subject, hash, r.auxiliary, head, commits_by_message, commits_by_hash), nil
+			}
+			if e != nil { fail(e); continue }
+		} else if r.mode == commands["bubble"] {
+			last = push_commit(text(commands["pick"]), subject, hash, r.auxiliary, bubble_head, commits_by_message, commits_by_hash)
+		} else if r.mode == commands["sink"] {
+			last = push_commit(text(commands["pick"]), subject, hash, r.auxiliary, sink_head, commits_by_message, commits_by_hash)
+		} else {
+			last = push_commit(text(r.mode), subject, hash, r.auxiliary, head, commits_by_message, commits_by_hash)
+		}
+		last_commit = last.next
+		if !relocated { ref_commit = last_commit }
+		subjects[subject] = append(subjects[subject], hash)
+	}
+
+	// concatenate the three lists together, moving bubble commits to the front of the pile
+	// and sink commits in front of them, so they end up after everything else in the todo.
+	head.next.prev, bubble_tail.prev.next = bubble_tail.prev, head.next
+	bubble_head.next.prev, sink_tail.prev.next = sink_tail.prev, bubble_head.next
+
+	// commits waiting for one further on go after it and whatever was folded into it in the todo.
+	for _, target := range waiting_for {
+		w := waiting[target]
+		node, ok := commits_by_hash[target]
+		if !ok {
+			// the commit never made it into the list, because something went wrong with it.
+			msg := fmt.Sprintf("Can't apply fixup (subject commit is missing: %s)", target)
+			diags = append(diags, &Diagnostic{Position: w.pos, Text: target, Msg: msg})
+			continue
+		}
+		for n := w.head.next; n != w.tail; n = n.next {
+			if n == node {
+				msg := fmt.Sprintf("Can't apply fixup (%s would end up folded into itself)", target)
+				diags = append(diags, &Diagnostic{Position: w.pos, Text: target, Msg: msg})
+				ok = false
+				break
+			}
+		}
+		if !ok { continue }
+		end := group_end(node, comment)
+		end.prev.splice_after(w.head.next, w.tail.prev)
+	}
+
+	for _, s := range p.selectors {
+		if e := s.check_range(tr.ranges); e != nil { diags = append(diags, &Diagnostic{Position: s.pos, Text: s.key, Msg: e.Error()}) }
+	}
+
+	// moves can't be trusted to find their commits if something has already gone wrong.
+	for _, m := range p.moves {
+		if len(diags) != 0 { break }
+		if e := apply_move(m, commits_by_hash, comment); e != nil { diags = append(diags, &Diagnostic{Position: m.pos, Text: m.hash, Msg: e.Error()}) }
+	}
+
+	if len(diags) != 0 { return nil, nil, diags }
+	return sink_head, tail, nil
+}
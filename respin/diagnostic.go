@@ -0,0 +1,74 @@
+package respin
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Position is a place in an instruction or todo file.
+type Position struct {
+	// File names the file, and may be empty.
+	File string
+	// Line is the 1-based physical line, counting blank lines and comments.
+	Line int
+	// Col is the 1-based column, in bytes.
+	Col int
+}
+
+// String formats the position the way compilers do, as file:line:col, leaving out the file
+// if it has no name.
+func (pos Position) String() string {
+	if pos.File == "" { return fmt.Sprintf("%d:%d", pos.Line, pos.Col) }
+	return fmt.Sprintf("%s:%d:%d", pos.File, pos.Line, pos.Col)
+}
+
+// Diagnostic is an error found at a particular place in an instruction or todo file.
+type Diagnostic struct {
+	Position
+	// Text is the offending text, if there is any.
+	Text string
+	Msg string
+}
+
+// Error formats the diagnostic as file:line:col: message, or just the message if it has no
+// position, which happens with instructions that were added without one.
+func (d *Diagnostic) Error() string {
+	if d.Line == 0 { return d.Msg }
+	return fmt.Sprintf("%s: %s", d.Position, d.Msg)
+}
+
+// Diagnostics is every error found in one go, in the order they were found.
+type Diagnostics []*Diagnostic
+
+func (ds Diagnostics) Error() string {
+	msgs := make([]string, len(ds))
+	for i, d := range ds { msgs[i] = d.Error() }
+	return strings.Join(msgs, "\n")
+}
+
+// err returns the diagnostics as an error, or nil if there aren't any.
+func (ds Diagnostics) err() error {
+	if len(ds) == 0 { return nil }
+	return ds
+}
+
+// the parts of an instruction an error can be blamed on.
+const (
+	in_action = iota
+	in_commit
+	in_args
+)
+
+// blamed_error is an error about one part of an instruction, so a diagnostic can point at it.
+// errors which aren't blamed on anything in particular point at the action.
+type blamed_error struct {
+	in int
+	err error
+}
+
+func (e *blamed_error) Error() string { return e.err.Error() }
+
+// blame makes an error about one part of an instruction.
+func blame(in int, format string, objs ...interface{}) error {
+	return &blamed_error{in: in, err: fmt.Errorf(format, objs...)}
+}
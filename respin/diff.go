@@ -0,0 +1,218 @@
+package respin
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// edit is one step of a line diff. op is ' ' for a line both sides share, '-' for a line only
+// in the old side, and '+' for a line only in the new side. a and b are the positions in the old
+// and new sides at which the step happens.
+type edit struct {
+	op byte
+	a, b int
+}
+
+// diff computes a shortest edit script turning a into b, using Myers' algorithm.
+func diff(a, b []string) []edit {
+	n, m := len(a), len(b)
+	max := n + m
+	v := make([]int, 2 * max + 2)
+
+	// remember the frontier at the start of every round, so the path can be walked backward.
+	var trace [][]int
+	done := false
+	for d := 0; d <= max && !done; d++ {
+		trace = append(trace, append([]int(nil), v...))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || k != d && v[max + k - 1] < v[max + k + 1] {
+				x = v[max + k + 1]
+			} else {
+				x = v[max + k - 1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] { x, y = x + 1, y + 1 }
+			v[max + k] = x
+			if x >= n && y >= m {
+				done = true
+				break
+			}
+		}
+	}
+
+	var out []edit
+	x, y := n, m
+	for d := len(trace) - 1; d >= 0; d-- {
+		v := trace[d]
+		k := x - y
+		var prev_k int
+		if k == -d || k != d && v[max + k - 1] < v[max + k + 1] {
+			prev_k = k + 1
+		} else {
+			prev_k = k - 1
+		}
+		prev_x := v[max + prev_k]
+		prev_y := prev_x - prev_k
+
+		for x > prev_x && y > prev_y {
+			x, y = x - 1, y - 1
+			out = append(out, edit{op: ' ', a: x, b: y})
+		}
+		if d == 0 { break }
+		if x == prev_x {
+			out = append(out, edit{op: '+', a: x, b: prev_y})
+		} else {
+			out = append(out, edit{op: '-', a: prev_x, b: y})
+		}
+		x, y = prev_x, prev_y
+	}
+
+	for i, j := 0, len(out) - 1; i < j; i, j = i + 1, j - 1 { out[i], out[j] = out[j], out[i] }
+	return out
+}
+
+// Diff writes a unified diff between two versions of a rebase todo file, with three lines of
+// context. Nothing is written if they are the same.
+func Diff(w io.Writer, a_name, b_name string, a, b *Todo) {
+	writeDiff(w, a_name, b_name, a.texts(), b.texts(), 3)
+}
+
+// hunk_range formats one side of a unified diff hunk header the way GNU diff does.
+func hunk_range(start, length int) string {
+	if length == 0 { return fmt.Sprintf("%d,0", start) }
+	if length == 1 { return fmt.Sprintf("%d", start + 1) }
+	return fmt.Sprintf("%d,%d", start + 1, length)
+}
+
+// writeDiff writes a unified diff from a to b, with the given amount of context around each change.
+// nothing is written if a and b are the same.
+func writeDiff(w io.Writer, a_name, b_name string, a, b []string, context int) {
+	edits := diff(a, b)
+
+	header := false
+	for i := 0; i < len(edits); {
+		// find the next change, and stretch the hunk over any changes close enough to share context.
+		for i < len(edits) && edits[i].op == ' ' { i++ }
+		if i == len(edits) { break }
+		end := i
+		for j := i; j < len(edits) && j - end <= 2 * context + 1; j++ {
+			if edits[j].op != ' ' { end = j }
+		}
+
+		start, stop := i - context, end + context + 1
+		if start < 0 { start = 0 }
+		if stop > len(edits) { stop = len(edits) }
+
+		if !header {
+			fmt.Fprintf(w, "--- %s\n+++ %s\n", a_name, b_name)
+			header = true
+		}
+
+		var a_len, b_len int
+		for _, e := range edits[start:stop] {
+			if e.op != '+' { a_len++ }
+			if e.op != '-' { b_len++ }
+		}
+		fmt.Fprintf(w, "@@ -%s +%s @@\n", hunk_range(edits[start].a, a_len), hunk_range(edits[start].b, b_len))
+
+		for _, e := range edits[start:stop] {
+			if e.op == '+' {
+				fmt.Fprintf(w, "+%s\n", b[e.b])
+			} else {
+				fmt.Fprintf(w, "%c%s\n", e.op, a[e.a])
+			}
+		}
+		i = stop
+	}
+}
+
+// todo_commit pulls the command and hash off a line of a rebase todo file, if it names a commit.
+func todo_commit(line, comment string) (command, string, bool) {
+	kind, mode := classify(line, comment)
+	if kind != commit_line && kind != merge_line { return "", "", false }
+
+	_, remainder := grab(line)
+	hash, remainder := grab(remainder)
+	switch {
+	case mode == commands["fixup"] && (hash == "-C" || hash == "-c"):
+		mode = commands["fixup" + hash]
+		hash, _ = grab(remainder)
+	case mode == commands["merge"]:
+		if hash != "-C" && hash != "-c" { return "", "", false }
+		mode = command(fmt.Sprintf("%s %s", mode, hash))
+		hash, _ = grab(remainder)
+	}
+	return mode, hash, len(hash) != 0
+}
+
+// todo_shape is the part of a rebase todo file which matters to a summary of changes.
+type todo_shape struct {
+	order []string
+	modes map[string]command
+	trailers map[string]int
+}
+
+func shape(lines []string, comment string) todo_shape {
+	s := todo_shape{modes: make(map[string]command), trailers: make(map[string]int)}
+	var last string
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if mode, hash, ok := todo_commit(line, comment); ok {
+			s.order = append(s.order, hash)
+			s.modes[hash] = mode
+			last = hash
+			continue
+		}
+
+		token, _ := grab(line)
+		mode := commands[token]
+		if last != "" && (mode == commands["exec"] || mode == commands["break"]) { s.trailers[last]++ }
+	}
+	return s
+}
+
+// Summary counts the ways in which the commits of a rebase todo file were changed.
+type Summary struct {
+	// Changed is the number of commits whose command changed.
+	Changed int
+	// Moved is the number of commits which moved relative to the others.
+	Moved int
+	// Trailed is the number of commits which gained break or exec lines.
+	Trailed int
+}
+
+// Summarize compares two versions of a rebase todo file.
+func Summarize(before, after *Todo) Summary {
+	return summarize(before.texts(), after.texts(), before.comment())
+}
+
+func summarize(before, after []string, comment string) Summary {
+	var out Summary
+	b, a := shape(before, comment), shape(after, comment)
+
+	// a commit has moved if it isn't part of the longest run of commits which kept their order.
+	var b_order, a_order []string
+	for _, hash := range b.order {
+		if _, ok := a.modes[hash]; ok { b_order = append(b_order, hash) }
+	}
+	for _, hash := range a.order {
+		if _, ok := b.modes[hash]; ok { a_order = append(a_order, hash) }
+	}
+	for _, e := range diff(b_order, a_order) {
+		if e.op == '-' { out.Moved++ }
+	}
+
+	for hash, mode := range a.modes {
+		old_mode, ok := b.modes[hash]
+		if !ok { continue }
+		if mode != old_mode { out.Changed++ }
+		if a.trailers[hash] > b.trailers[hash] { out.Trailed++ }
+	}
+	return out
+}
+
+func (s Summary) String() string {
+	return fmt.Sprintf("%d commits changed command, %d moved, %d gained exec/break lines", s.Changed, s.Moved, s.Trailed)
+}
@@ -0,0 +1,103 @@
+package respin
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// subject_format pulls the subject back out of what git wrote after the hash on a commit line,
+// which is the commit formatted with rebase.instructionFormat.
+type subject_format struct {
+	re *regexp.Regexp
+}
+
+// placeholder_end finds where the git pretty format placeholder starting at format[i] (just after
+// its %) ends. it only needs to be good enough to skip over placeholders, not to understand them.
+func placeholder_end(format string, i int) int {
+	if i >= len(format) { return i }
+	switch c := format[i]; {
+	case c == '(':
+		// %(trailers:...), %(describe) and friends.
+		if j := strings.IndexByte(format[i:], ')'); j != -1 { return i + j + 1 }
+		return len(format)
+	case c == 'C':
+		// %C(...), or one of the named colors.
+		if strings.HasPrefix(format[i + 1:], "(") { return placeholder_end(format, i + 1) }
+		for _, color := range []string{"red", "green", "blue", "reset"} {
+			if strings.HasPrefix(format[i + 1:], color) { return i + 1 + len(color) }
+		}
+		return i + 1
+	case c == 'w' || c == '<' || c == '>':
+		// %w(...), %<(N), %>(N), %>>(N) and %><(N) change the layout of what follows.
+		j := i + 1
+		if j < len(format) && (format[j] == '<' || format[j] == '>') { j++ }
+		if j < len(format) && format[j] == '(' { return placeholder_end(format, j) }
+		return j
+	case c == 'x':
+		return i + 3
+	case strings.IndexByte("acgG", c) != -1:
+		// author, committer, reflog and signature placeholders are two letters long.
+		return i + 2
+	}
+	return i + 1
+}
+
+// compile_format turns rebase.instructionFormat into something which can find the subject in
+// text formatted with it. the subject is the first %s, and everything else matches anything.
+// nil comes back if there's nothing to do, because the text is nothing but the subject, or if
+// there's nothing that can be done, because the format has no subject in it.
+func compile_format(format string) *subject_format {
+	if format == "" || format == "%s" { return nil }
+
+	var b strings.Builder
+	b.WriteString(`(?s)^`)
+	subject := false
+	for i := 0; i < len(format); {
+		if format[i] != '%' {
+			j := strings.IndexByte(format[i:], '%')
+			if j == -1 { j = len(format) - i }
+			b.WriteString(regexp.QuoteMeta(format[i:i + j]))
+			i += j
+			continue
+		}
+
+		end := placeholder_end(format, i + 1)
+		if end > len(format) { end = len(format) }
+		switch p := format[i + 1:end]; {
+		case p == "%":
+			b.WriteString("%")
+		case p == "n":
+			b.WriteString(`\n`)
+		case len(p) == 3 && p[0] == 'x':
+			// a byte given in hex. bytes which aren't ascii can't go in a pattern on their own.
+			if c, err := strconv.ParseUint(p[1:], 16, 8); err != nil {
+				b.WriteString(regexp.QuoteMeta("%" + p))
+			} else if c < 0x80 {
+				b.WriteString(regexp.QuoteMeta(string([]byte{byte(c)})))
+			} else {
+				b.WriteString(`.*?`)
+			}
+		case p == "s" && !subject:
+			// the subject is greedy, so that text after it which looks like the rest of the
+			// format ends up outside it.
+			b.WriteString(`(.*)`)
+			subject = true
+		default:
+			b.WriteString(`.*?`)
+		}
+		i = end
+	}
+	if !subject { return nil }
+	b.WriteString(`$`)
+	return &subject_format{re: regexp.MustCompile(b.String())}
+}
+
+// subject finds the subject in text written with the format. text which doesn't fit the format
+// is taken to be the subject, like it would be without one.
+func (f *subject_format) subject(text string) string {
+	if f == nil { return text }
+	m := f.re.FindStringSubmatch(text)
+	if m == nil { return text }
+	return m[1]
+}
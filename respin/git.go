@@ -0,0 +1,51 @@
+package respin
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// git runs git with the given arguments in the current directory, and returns what it printed,
+// without the trailing newline.
+func git(args ...string) (string, error) {
+	var out, errs bytes.Buffer
+	cmd := exec.Command("git", args...)
+	cmd.Stdout, cmd.Stderr = &out, &errs
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(errs.String()); msg != "" { return "", fmt.Errorf("%s", msg) }
+		return "", err
+	}
+	return strings.TrimRight(out.String(), "\n"), nil
+}
+
+// RevParse resolves a revision, like HEAD~3, v1.2^ or a branch name, to the full hash of the
+// commit it names, using git rev-parse in the current directory. It can be used as Plan.Resolve.
+func RevParse(name string) (string, error) {
+	if strings.HasPrefix(name, "-") { return "", fmt.Errorf("not a valid revision") }
+	// with --quiet, git says nothing at all about names that aren't commits.
+	hash, err := git("rev-parse", "--verify", "--quiet", name + "^{commit}")
+	if _, ok := err.(*exec.ExitError); ok || err == nil && hash == "" { return "", fmt.Errorf("not a commit in this repository") }
+	return hash, err
+}
+
+// ConfiguredInstructionFormat reads rebase.instructionFormat from git's config, for
+// Todo.InstructionFormat. It is empty if it isn't set.
+func ConfiguredInstructionFormat() (string, error) {
+	format, err := git("config", "--get", "rebase.instructionFormat")
+	// git config says nothing, and fails, when the key isn't set.
+	if _, ok := err.(*exec.ExitError); ok { return "", nil }
+	return format, err
+}
+
+// ConfiguredCommentChar reads core.commentString, or failing that core.commentChar, from git's
+// config, for Todo.CommentChar. It is empty if neither is set.
+func ConfiguredCommentChar() (string, error) {
+	for _, key := range []string{"core.commentString", "core.commentChar"} {
+		comment, err := git("config", "--get", key)
+		if _, ok := err.(*exec.ExitError); ok { continue }
+		return comment, err
+	}
+	return "", nil
+}
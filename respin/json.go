@@ -0,0 +1,135 @@
+package respin
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// decode_object unpacks the JSON object in raw into fields, by key. keys missing from raw are
+// left alone, and keys in raw which aren't in fields are errors. errors name the JSON path.
+func decode_object(raw json.RawMessage, path string, fields map[string]interface{}) error {
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &obj); err != nil || obj == nil { return fmt.Errorf("%s: expected an object", path) }
+
+	keys := make([]string, 0, len(obj))
+	for k := range obj { keys = append(keys, k) }
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		field, ok := fields[k]
+		if !ok { return fmt.Errorf("%s.%s: unknown field", path, k) }
+		if err := json.Unmarshal(obj[k], field); err != nil {
+			if t, ok := err.(*json.UnmarshalTypeError); ok { return fmt.Errorf("%s.%s: expected %s, got %s", path, k, t.Type, t.Value) }
+			return fmt.Errorf("%s.%s: %s", path, k, err)
+		}
+	}
+	return nil
+}
+
+// readSettingsJSON reads instructions from a JSON document, which is an array of objects like:
+//     {"action": "squash", "commit": "abc123", "args": "def456", "trailers": [{"action": "exec", "args": "make"}]}
+// action, commit and args mean the same as COMMAND, COMMIT-ID and ARGS in the line based format.
+// each trailer is an exec or break (or update-ref) applied to the same commit. action may be left
+// out of an object that has trailers.
+func readSettingsJSON(p *Plan, r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil { return err }
+
+	// the entries are decoded one at a time, to find out where each one starts.
+	var entries []json.RawMessage
+	var starts []int
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if t, err := dec.Token(); err != nil || t != json.Delim('[') {
+		if err == nil { err = fmt.Errorf("got %v", t) }
+		return Diagnostics{&Diagnostic{Position: json_position(p.File, data, dec.InputOffset()), Msg: fmt.Sprintf("$: expected an array of instructions (%s)", err)}}
+	}
+	for dec.More() {
+		start := int(dec.InputOffset())
+		for start < len(data) && strings.IndexByte(" \t\r\n,", data[start]) != -1 { start++ }
+
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return Diagnostics{&Diagnostic{Position: json_position(p.File, data, int64(start)), Msg: fmt.Sprintf("$: expected an array of instructions (%s)", err)}}
+		}
+		entries, starts = append(entries, raw), append(starts, start)
+	}
+	if _, err := dec.Token(); err != nil {
+		return Diagnostics{&Diagnostic{Position: json_position(p.File, data, dec.InputOffset()), Msg: fmt.Sprintf("$: expected an array of instructions (%s)", err)}}
+	}
+
+	var diags Diagnostics
+	for i, raw := range entries {
+		pos := json_position(p.File, data, int64(starts[i]))
+		if err := readEntryJSON(p, raw, fmt.Sprintf("$[%d]", i), pos); err != nil {
+			diags = append(diags, &Diagnostic{Position: pos, Text: string(raw), Msg: err.Error()})
+		}
+	}
+
+	return diags.err()
+}
+
+// readEntryJSON reads one entry of a JSON instruction file, whose JSON path is path.
+func readEntryJSON(p *Plan, raw json.RawMessage, path string, pos Position) error {
+	var action, commit, args string
+	var trailers []json.RawMessage
+	err := decode_object(raw, path, map[string]interface{}{"action": &action, "commit": &commit, "args": &args, "trailers": &trailers})
+	if err != nil { return err }
+
+	if len(commit) == 0 { return fmt.Errorf("%s.commit: Missing hash string", path) }
+	if len(action) == 0 && len(trailers) == 0 { return fmt.Errorf("%s: Missing action or trailers", path) }
+
+	// errors found later, once the commits are resolved, are blamed the same way.
+	diagnose := func(commit_path, path string) func(err error) *Diagnostic {
+		return func(err error) *Diagnostic {
+			return &Diagnostic{Position: pos, Text: string(raw), Msg: blamed_path(err, commit_path, path).Error()}
+		}
+	}
+
+	if len(action) != 0 {
+		i := Instruction{Action: action, Commit: commit, Args: args, Pos: pos}
+		p.diagnose[i] = diagnose(path, path)
+		if err := instruct(p, i); err != nil { return blamed_path(err, path, path) }
+	}
+
+	outer := path
+	for j, raw := range trailers {
+		path := fmt.Sprintf("%s.trailers[%d]", path, j)
+
+		var action, args string
+		err := decode_object(raw, path, map[string]interface{}{"action": &action, "args": &args})
+		if err != nil { return err }
+
+		mode := commands[action]
+		if mode != commands["exec"] && mode != commands["break"] && mode != commands["update-ref"] {
+			return fmt.Errorf("%s.action: expected exec, break or update-ref, got %q", path, action)
+		}
+		i := Instruction{Action: action, Commit: commit, Args: args, Pos: pos}
+		p.diagnose[i] = diagnose(outer, path)
+		if err := instruct(p, i); err != nil { return blamed_path(err, outer, path) }
+	}
+	return nil
+}
+
+// blamed_path puts the JSON path of whatever an instruction error is blamed on in front of it.
+// the commit is at commit_path, since trailers take theirs from the entry they belong to.
+func blamed_path(err error, commit_path, path string) error {
+	field := "action"
+	if b, ok := err.(*blamed_error); ok && b.in == in_commit {
+		return fmt.Errorf("%s.commit: %s", commit_path, err)
+	} else if ok && b.in == in_args {
+		field = "args"
+	}
+	return fmt.Errorf("%s.%s: %s", path, field, err)
+}
+
+// json_position turns a byte offset into a JSON document into a position.
+func json_position(file string, data []byte, offset int64) Position {
+	if offset > int64(len(data)) { offset = int64(len(data)) }
+	before := data[:offset]
+	line := bytes.Count(before, []byte("\n")) + 1
+	return Position{File: file, Line: line, Col: len(before) - (bytes.LastIndexByte(before, '\n') + 1) + 1}
+}
@@ -0,0 +1,223 @@
+package respin
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Instruction says what to do with one commit. Action, Commit and Args mean the same things as
+// COMMAND, COMMIT-ID and ARGS do in an instruction file.
+type Instruction struct {
+	Action string
+	Commit string
+	Args string
+
+	// Pos is where the instruction came from, for diagnostics. It is filled in when instructions
+	// are read from a file, and may be left zero otherwise.
+	Pos Position
+}
+
+func (i Instruction) String() string {
+	return strings.TrimSpace(fmt.Sprintf("%s %s %s", i.Action, i.Commit, i.Args))
+}
+
+// located formats the instruction along with where it came from, if that is known.
+func (i Instruction) located() string {
+	if i.Pos.Line == 0 { return i.String() }
+	return fmt.Sprintf("%s at %s", i, i.Pos)
+}
+
+// Result is what came of applying a plan to a rebase todo file.
+type Result struct {
+	// Todo is the rewritten todo file.
+	Todo *Todo
+	// Unmatched holds the instructions which didn't match anything in the todo, in the order
+	// they were given. moves never show up here, because they fail instead.
+	Unmatched []Instruction
+	// Warnings are problems with the todo which didn't stop it being rewritten, like fixups which
+	// could have belonged to more than one commit.
+	Warnings Diagnostics
+}
+
+// ConflictPolicy says what to do when two instructions disagree about what to do with the
+// same commit, like drop 1111 followed by pick 1111.
+type ConflictPolicy int
+
+const (
+	// LastWins keeps the later instruction.
+	LastWins ConflictPolicy = iota
+	// FirstWins keeps the earlier instruction.
+	FirstWins
+	// FailOnConflict makes the later instruction an error.
+	FailOnConflict
+)
+
+// OrphanPolicy says what to do with a fixup whose subject names a commit which isn't in the
+// todo, like a fixup of something from before the start of the rebase, or a fixup with no
+// commit before it to fold into. Every policy but OrphanError warns about each one.
+type OrphanPolicy int
+
+const (
+	// OrphanError makes every such fixup an error.
+	OrphanError OrphanPolicy = iota
+	// OrphanLeave leaves the line as it was in the todo.
+	OrphanLeave
+	// OrphanDrop drops the commit.
+	OrphanDrop
+	// OrphanPick picks the commit like any other.
+	OrphanPick
+)
+
+// CommandStyle says how commands are written in the rewritten todo, like pick or p.
+type CommandStyle int
+
+const (
+	// PreserveCommands leaves commands which weren't changed as they were, and writes the rest
+	// the way the todo does, long unless it starts with a short one. That way a todo written
+	// with rebase.abbreviateCommands stays short.
+	PreserveCommands CommandStyle = iota
+	// LongCommands writes every command in full.
+	LongCommands
+	// ShortCommands abbreviates every command which has an abbreviation.
+	ShortCommands
+)
+
+// Conflict is a pair of instructions which disagreed, and which one of them was kept.
+type Conflict struct {
+	Kept Instruction
+	Dropped Instruction
+}
+
+func (c Conflict) String() string {
+	return fmt.Sprintf("%s conflicts with %s, keeping %s", c.Dropped.located(), c.Kept.located(), c.Kept)
+}
+
+// Plan is a set of instructions, ready to be applied to a rebase todo file.
+type Plan struct {
+	// OnConflict says what happens when instructions added later conflict with earlier ones.
+	OnConflict ConflictPolicy
+	// OnOrphan says what happens to fixups whose subject names a commit that isn't in the todo,
+	// and to fixups with no commit before them to fold into.
+	OnOrphan OrphanPolicy
+	// Style says how commands are written in the rewritten todo, trailers included.
+	Style CommandStyle
+	// File names the instruction file being read, for diagnostics. Set it before each Read or
+	// ReadJSON, if there is more than one.
+	File string
+	// Resolve turns a name which isn't a hash, like HEAD~3, v1.2^ or a branch, into the hash of
+	// the commit it names. Names which can't be resolved are errors. If Resolve is nil, such
+	// names are only matched against the todo as they are. RevParse asks git.
+	Resolve func(name string) (string, error)
+
+	config map[string]reaction
+	selectors []*selector
+	moves []move
+	instructions []Instruction
+	decided map[string]Instruction
+	conflicts []Conflict
+	refs map[string]Instruction
+	// diagnose turns an error about an instruction which was read from a file into a diagnostic
+	// which points at the part of it that is to blame, for errors found after it was read.
+	diagnose map[Instruction]func(err error) *Diagnostic
+}
+
+// NewPlan returns an empty plan, which leaves todo files as they are. The one exception is a
+// todo with mixed line endings, which comes back using the first one throughout.
+func NewPlan() *Plan {
+	return &Plan{config: make(map[string]reaction), decided: make(map[string]Instruction), refs: make(map[string]Instruction), diagnose: make(map[Instruction]func(err error) *Diagnostic)}
+}
+
+// Conflicts returns the conflicting instructions which have been added to the plan so far,
+// in the order they were found. With FailOnConflict there are none, because adding them fails.
+func (p *Plan) Conflicts() []Conflict {
+	return p.conflicts
+}
+
+// Add adds an instruction to the plan.
+func (p *Plan) Add(i Instruction) error {
+	return instruct(p, i)
+}
+
+// Read adds instructions to the plan from an instruction file, one per line. Bad instructions
+// are skipped, and returned as Diagnostics.
+func (p *Plan) Read(r io.Reader) error {
+	return readSettings(p, bufio.NewScanner(r))
+}
+
+// ReadJSON adds instructions to the plan from a JSON instruction file. Bad instructions are
+// skipped, and returned as Diagnostics.
+func (p *Plan) ReadJSON(r io.Reader) error {
+	return readSettingsJSON(p, r)
+}
+
+// Apply rewrites a rebase todo file according to a plan. The todo passed in is left alone.
+// Errors, whether they are found in the todo or are about the instructions, are Diagnostics.
+// Hashes in the plan match those in the todo if either is an abbreviation of the other, at
+// least 4 characters long.
+func Apply(p *Plan, t *Todo) (*Result, error) {
+	// bad instructions don't stop the todo being checked too, so everything is reported at once.
+	q, origs, diags := resolve(p, t)
+	tr := new_tracker()
+	head, tail, err := parseInput(q, tr, t)
+	if d, ok := err.(Diagnostics); ok {
+		diags = append(diags, d...)
+	} else if err != nil {
+		return nil, err
+	}
+	if diags != nil { return nil, diags }
+
+	res := &Result{Todo: listTodo(head, tail, t.eol(), new_spelling(q.Style, t, t.comment()), t.comment()), Warnings: tr.warnings}
+	res.Todo.InstructionFormat, res.Todo.CommentChar = t.InstructionFormat, t.CommentChar
+
+	// a todo which didn't end with a newline still doesn't.
+	if n, m := len(t.Lines), len(res.Todo.Lines); n != 0 && m != 0 && t.Lines[n - 1].End == "" { res.Todo.Lines[m - 1].End = "" }
+
+	// instructions which only conflict now that their hashes are resolved are warned about,
+	// since nobody has seen them yet.
+	for _, c := range q.conflicts {
+		kept, dropped := origs[c.Kept], origs[c.Dropped]
+		if kept.Commit == dropped.Commit { continue }
+		later := dropped
+		if q.OnConflict == LastWins { later = kept }
+		res.Warnings = append(res.Warnings, &Diagnostic{Position: later.Pos, Text: later.Commit, Msg: Conflict{Kept: kept, Dropped: dropped}.String()})
+	}
+
+	for _, i := range q.instructions {
+		mode, key := commands[i.Action], i.Commit
+		if mode == commands["move"] || key == "default" { continue }
+		if !tr.used[key] { res.Unmatched = append(res.Unmatched, origs[i]) }
+	}
+	return res, nil
+}
+
+// listTodo turns the list between head and tail into a todo, ending each line with eol, and
+// spelling the commands of trailers with s. update-ref lines wait until the fixups and squashes
+// after their commit are done, so the ref ends up on the finished commit, unless the todo already
+// had them in among the fixups.
+func listTodo(head, tail *output_node, eol string, s spelling, comment string) *Todo {
+	t := &Todo{}
+	folding := func(n *output_node) bool {
+		mode, _, ok := todo_commit(strings.TrimSpace(n.line), comment)
+		return ok && folds(mode)
+	}
+
+	var refs []trailer
+	for node := tail.prev; node != head; node = node.prev {
+		if !folding(node) {
+			for _, tr := range refs { t.Lines = append(t.Lines, Line{Text: tr.command(s), End: eol}) }
+			refs = nil
+		}
+		t.Lines = append(t.Lines, Line{Text: node.line, End: eol})
+		for _, tr := range node.trailers {
+			if u, ok := tr.(update_ref_trailer); ok && !u.pinned && node.prev != head && folding(node.prev) {
+				refs = append(refs, tr)
+				continue
+			}
+			t.Lines = append(t.Lines, Line{Text: tr.command(s), End: eol})
+		}
+	}
+	for _, tr := range refs { t.Lines = append(t.Lines, Line{Text: tr.command(s), End: eol}) }
+	return t
+}
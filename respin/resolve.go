@@ -0,0 +1,160 @@
+package respin
+
+import (
+	"fmt"
+	"strings"
+)
+
+// is_hash reports whether s looks like a (possibly abbreviated) commit hash.
+func is_hash(s string) bool {
+	if len(s) == 0 { return false }
+	for _, r := range s {
+		if !(r >= '0' && r <= '9' || r >= 'a' && r <= 'f' || r >= 'A' && r <= 'F') { return false }
+	}
+	return true
+}
+
+// min_abbrev is the shortest abbreviation git accepts for a commit hash. anything shorter only
+// matches a hash which is exactly the same.
+const min_abbrev = 4
+
+// same_commit reports whether two hashes could name the same commit, because they are the same, or
+// because one of them is an abbreviation of the other at least min_abbrev characters long.
+func same_commit(a, b string) bool {
+	if a == b { return true }
+	if len(a) < min_abbrev || len(b) < min_abbrev { return false }
+	return strings.HasPrefix(a, b) || strings.HasPrefix(b, a)
+}
+
+// resolve_hash finds the hash the todo uses for the commit named by hash. either may be an
+// abbreviation of the other, so long as only one commit in the todo fits. anything which isn't a
+// hash, or which matches nothing, comes back as it was.
+func resolve_hash(hashes []string, hash string) (string, error) {
+	if !is_hash(hash) { return hash, nil }
+
+	var found []string
+	for _, h := range hashes {
+		if h == hash { return h, nil }
+		if same_commit(h, hash) { found = append(found, h) }
+	}
+	if len(found) > 1 { return "", fmt.Errorf("Ambiguous commit %s: it could be any of %s", hash, strings.Join(found, ", ")) }
+	if len(found) == 1 { return found[0], nil }
+	return hash, nil
+}
+
+// resolver turns the names instructions use for commits into the hashes the todo uses for them.
+// hashes are matched against the todo directly, and anything else that isn't a selector is passed
+// to the plan's Resolve, if it has one. so is a name that only looks like a hash, such as a branch
+// called cafe, when it matches nothing in the todo. names are only resolved once each. subjects
+// holds the subjects of the commits in the todo, which fixups and squashes can be aimed at too.
+type resolver struct {
+	hashes []string
+	subjects map[string]bool
+	resolve func(name string) (string, error)
+	cache map[string]string
+}
+
+func (r *resolver) commit(name string) (string, error) {
+	if name == "" || name == "default" { return name, nil }
+	if is_hash(name) {
+		hash, err := resolve_hash(r.hashes, name)
+		if err != nil || r.resolve == nil || r.in_todo(hash) { return hash, err }
+
+		// it isn't in the todo, but it might be a ref. if it isn't that either, it's a hash of
+		// something else, and stays as it was.
+		full, err := r.lookup(name)
+		if err != nil { return name, nil }
+		if full, err = resolve_hash(r.hashes, full); err != nil || !r.in_todo(full) { return name, err }
+		return full, nil
+	}
+	if r.resolve == nil { return name, nil }
+
+	hash, err := r.lookup(name)
+	if err != nil { return "", fmt.Errorf("Can't resolve %s: %s", name, err) }
+	return resolve_hash(r.hashes, hash)
+}
+
+// lookup passes a name to the plan's Resolve, once.
+func (r *resolver) lookup(name string) (string, error) {
+	if hash, ok := r.cache[name]; ok { return hash, nil }
+	hash, err := r.resolve(name)
+	if err != nil { return "", err }
+	r.cache[name] = hash
+	return hash, nil
+}
+
+// in_todo reports whether hash is exactly one of the hashes in the todo.
+func (r *resolver) in_todo(hash string) bool {
+	for _, h := range r.hashes {
+		if h == hash { return true }
+	}
+	return false
+}
+
+// instruction rewrites the commits in an instruction the way the todo spells them: the commit,
+// both ends of a range, the commit a fixup or squash is aimed at, and where a move goes.
+// drop-ref names a ref rather than a commit, so it is left alone, and so is a fixup or squash
+// aimed at a commit by its subject.
+func (r *resolver) instruction(i Instruction) (Instruction, error) {
+	var err error
+	mode := commands[i.Action]
+	if mode == commands["drop-ref"] { return i, nil }
+
+	if sel, _ := parse_selector(i.Commit); sel == nil {
+		if i.Commit, err = r.commit(i.Commit); err != nil { return i, &blamed_error{in: in_commit, err: err} }
+	} else if sel.match == nil {
+		from, to := sel.from, sel.to
+		if from, err = r.commit(from); err != nil { return i, &blamed_error{in: in_commit, err: err} }
+		if to, err = r.commit(to); err != nil { return i, &blamed_error{in: in_commit, err: err} }
+		i.Commit = from + ".." + to
+	}
+
+	if folds(mode) && !r.subjects[i.Args] {
+		if i.Args, err = r.commit(i.Args); err != nil { return i, &blamed_error{in: in_args, err: err} }
+	} else if mode == commands["move"] {
+		direction, rest := grab(i.Args)
+		target, _ := grab(rest)
+		if target, err = r.commit(target); err != nil { return i, &blamed_error{in: in_args, err: err} }
+		i.Args = direction + " " + target
+	}
+	return i, nil
+}
+
+// resolve makes a copy of a plan whose commits are spelled the way the todo spells them, so that
+// instructions can use full hashes, abbreviations of a different length, or anything the plan's
+// Resolve understands. instructions which turn out to be about the same commit are checked for
+// conflicts all over again. origs maps the copy's instructions back to the ones they came from.
+func resolve(p *Plan, t *Todo) (*Plan, map[Instruction]Instruction, Diagnostics) {
+	r := &resolver{subjects: make(map[string]bool), resolve: p.Resolve, cache: make(map[string]string)}
+	seen, comment, format := make(map[string]bool), t.comment(), compile_format(t.InstructionFormat)
+	for _, l := range t.Lines {
+		line := strings.TrimSpace(l.Text)
+		if kind, _ := classify(line, comment); kind == commit_line {
+			_, remainder := grab(line)
+			_, remainder = grab(remainder)
+			r.subjects[format.subject(remainder)] = true
+		}
+		if _, hash, ok := todo_commit(line, comment); ok && !seen[hash] {
+			seen[hash] = true
+			r.hashes = append(r.hashes, hash)
+		}
+	}
+
+	q := NewPlan()
+	q.OnConflict, q.OnOrphan, q.Style, q.File, q.Resolve = p.OnConflict, p.OnOrphan, p.Style, p.File, p.Resolve
+	origs := make(map[Instruction]Instruction)
+	var diags Diagnostics
+	for _, i := range p.instructions {
+		j, err := r.instruction(i)
+		if err == nil { err = instruct(q, j) }
+		if err != nil {
+			// instructions read from a file point at the part to blame, like they did when they were read.
+			d := &Diagnostic{Position: i.Pos, Text: i.Commit, Msg: err.Error()}
+			if diagnose, ok := p.diagnose[i]; ok { d = diagnose(err) }
+			diags = append(diags, d)
+			continue
+		}
+		origs[q.instructions[len(q.instructions) - 1]] = i
+	}
+	return q, origs, diags
+}
@@ -0,0 +1,304 @@
+// Package respin reads git rebase todo files, and rewrites them according to a plan.
+// It is the engine behind the rebase-respin command.
+package respin
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+type command string
+type trailer interface {
+	command(s spelling) string
+}
+
+type break_trailer struct {}
+func (t break_trailer) command(s spelling) string { return s.command(commands["break"]) }
+
+type exec_trailer struct {
+	cmd string
+}
+func (t exec_trailer) command(s spelling) string { return fmt.Sprintf("%s %s", s.command(commands["exec"]), t.cmd) }
+
+// update_ref_trailer is an update-ref line. line is set if it was already in the todo, and then
+// it is kept as it was, unless its command has to be spelled differently. pinned is set if it was
+// already in the middle of its commit's fixups, where it stays rather than going after them.
+type update_ref_trailer struct {
+	ref string
+	line string
+	pinned bool
+}
+func (t update_ref_trailer) command(s spelling) string {
+	if t.line != "" { return s.line(t.line) }
+	return fmt.Sprintf("%s %s", s.command(commands["update-ref"]), t.ref)
+}
+
+// kept_trailer is an exec or break line which was already in the todo, kept as it was, unless
+// its command has to be spelled differently.
+type kept_trailer struct {
+	line string
+}
+func (t kept_trailer) command(s spelling) string { return s.line(t.line) }
+
+// the kinds of line a rebase todo file has. instructions only act on commit and merge lines. the
+// others give the rebase its shape, and are kept as they are.
+type line_kind int
+
+const (
+	// blank lines, comments, noop, and anything that isn't a command at all.
+	verbatim_line line_kind = iota
+	// pick, reword, edit, squash, fixup and drop.
+	commit_line
+	// merge, which carries a commit if it names one with -C or -c.
+	merge_line
+	// label and reset, which stay exactly where they are, and which nothing attaches itself across.
+	anchor_line
+	// exec and break, which ride along with the commit before them.
+	rider_line
+	// update-ref, which rides along too, but which instructions can drop or put somewhere else.
+	ref_line
+)
+
+// classify works out what kind of line a todo line is, and what its command is. lines starting
+// with comment are comments.
+func classify(line, comment string) (line_kind, command) {
+	line = strings.TrimSpace(line)
+	if len(line) == 0 || strings.HasPrefix(line, comment) { return verbatim_line, "" }
+
+	token, _ := grab(line)
+	mode, ok := todo_commands[token]
+	if !ok { mode, ok = commands[token] }
+	switch {
+	case !ok || mode == commands["override"] || mode == commands["noop"]:
+		return verbatim_line, mode
+	case mode == commands["merge"]:
+		return merge_line, mode
+	case mode == commands["label"] || mode == commands["reset"]:
+		return anchor_line, mode
+	case mode == commands["exec"] || mode == commands["break"]:
+		return rider_line, mode
+	case mode == commands["update-ref"]:
+		return ref_line, mode
+	}
+	return commit_line, mode
+}
+
+type reaction struct {
+	mode command
+	extra string
+	auxiliary []trailer
+	// keep is set by an override instruction. without it, a reaction with no mode only has
+	// trailers to add, and leaves the command to whatever else matched.
+	keep bool
+}
+
+type output_node struct {
+	next, prev *output_node
+	line string
+	msg string
+	trailers []trailer
+}
+
+// a move instruction, which puts a commit (and everything that moves with it) after or before another.
+type move struct {
+	hash string
+	after bool
+	target string
+	pos Position
+}
+
+func newList() (*output_node, *output_node) {
+	head, tail := &output_node{}, &output_node{}
+	head.next, tail.prev = tail, head
+	return head, tail
+}
+
+func (this *output_node) insert_after(n *output_node) {
+	next := this.next
+	next.prev, this.next = n, n
+	n.prev, n.next = this, next
+}
+
+// splice_after links the run of nodes from first to last back into the list, after this.
+func (this *output_node) splice_after(first, last *output_node) {
+	next := this.next
+	this.next, first.prev = first, this
+	last.next, next.prev = next, last
+}
+
+// unlink takes the run of nodes from first to last out of the list.
+func unlink(first, last *output_node) {
+	first.prev.next, last.next.prev = last.next, first.prev
+}
+
+var commands = map[string]command{
+	// these are commands provided by git.
+	"pick":   "pick",
+	"p":      "pick",
+	"reword": "reword",
+	"r":      "reword",
+	"edit":   "edit",
+	"e":      "edit",
+	"squash": "squash",
+	"s":      "squash",
+	"fixup":  "fixup",
+	"f":      "fixup",
+	"drop":   "drop",
+	"d":      "drop",
+	"exec":   "exec",
+	"x":      "exec",
+	"break":  "break",
+	"b":      "break",
+	"override": "",
+	"o":        "",
+	"label":    "label",
+	"l":        "label",
+	"reset":    "reset",
+	"t":        "reset",
+	"merge":    "merge",
+	"m":        "merge",
+	"update-ref": "update-ref",
+	"noop":     "noop",
+	"":         "",
+
+	// these are extra commands provided by rebase-respin that git rebase isn't aware of.
+	"bubble":   "bubble",
+	"u":        "bubble",
+	"sink":     "sink",
+	"k":        "sink",
+	"drop-ref": "drop-ref",
+	"move":     "move",
+	"autosquash": "autosquash",
+	"fixup-C":  "fixup -C",
+	"f-C":      "fixup -C",
+	"fixup-c":  "fixup -c",
+	"f-c":      "fixup -c",
+}
+
+// git abbreviates some commands in the rebase todo file differently than rebase-respin does
+// in its instructions. these take precedence over commands when reading a todo file.
+var todo_commands = map[string]command{
+	"u": "update-ref",
+}
+
+// abbreviations are the short forms git writes commands in, with rebase.abbreviateCommands.
+var abbreviations = map[command]string{
+	"pick":       "p",
+	"reword":     "r",
+	"edit":       "e",
+	"squash":     "s",
+	"fixup":      "f",
+	"drop":       "d",
+	"exec":       "x",
+	"break":      "b",
+	"label":      "l",
+	"reset":      "t",
+	"merge":      "m",
+	"update-ref": "u",
+}
+
+// spelling says how commands are written in the todo: all long, all short, or (with preserve)
+// left as they were, with only new or changed commands written short or long.
+type spelling struct {
+	short bool
+	preserve bool
+}
+
+// new_spelling works out how commands should be written in a todo. a preserved style follows the
+// first command in it.
+func new_spelling(style CommandStyle, t *Todo, comment string) spelling {
+	switch style {
+	case LongCommands:
+		return spelling{}
+	case ShortCommands:
+		return spelling{short: true}
+	}
+	for _, l := range t.Lines {
+		if kind, mode := classify(l.Text, comment); kind != verbatim_line {
+			token, _ := grab(l.Text)
+			return spelling{short: token != string(mode) && token == abbreviations[mode], preserve: true}
+		}
+	}
+	return spelling{preserve: true}
+}
+
+// command spells a command. options, like the -C of fixup -C, are kept.
+func (s spelling) command(mode command) string {
+	if !s.short { return string(mode) }
+	name, option := grab(string(mode))
+	if short, ok := abbreviations[command(name)]; ok { name = short }
+	if option != "" { return name + " " + option }
+	return name
+}
+
+// keep spells mode, unless the todo had it already, as token, and it's being preserved.
+func (s spelling) keep(token string, was, mode command) string {
+	if s.preserve && was == mode { return token }
+	return s.command(mode)
+}
+
+// line respells the command at the start of a line from the todo, leaving the rest of the line,
+// whitespace and all, alone. preserved lines aren't touched.
+func (s spelling) line(line string) string {
+	if s.preserve { return line }
+	token, _ := grab(line)
+	mode, ok := todo_commands[token]
+	if !ok { mode, ok = commands[token] }
+	if _, known := abbreviations[mode]; !ok || !known { return line }
+	i := strings.Index(line, token)
+	return line[:i] + s.command(mode) + line[i + len(token):]
+}
+
+// folds reports whether a command folds its commit into the one before it.
+func folds(mode command) bool {
+	return mode == commands["fixup"] || mode == commands["squash"] || mode == commands["fixup-C"] || mode == commands["fixup-c"]
+}
+
+// normalize_ref turns a branch name into a full ref name. full ref names are left alone.
+func normalize_ref(name string) string {
+	if strings.HasPrefix(name, "refs/") { return name }
+	return "refs/heads/" + name
+}
+
+// grab one token off the front of a string.
+// token boundaries are whitespace.
+// whitespace is trimmed from the remainder string.
+// if there is no suitable token, an empty string is returned ad infinitum.
+func grab(s string) (string, string) {
+	var i int
+	var r rune
+	var end bool
+	end = true
+	for i, r = range s {
+		if !unicode.IsSpace(r) {
+			end = false
+			break
+		}
+	}
+	if end { i = len(s) }
+	s = s[i:]
+
+	end = true
+	for i, r = range s {
+		if unicode.IsSpace(r) {
+			end = false
+			break
+		}
+	}
+	if end { i = len(s) }
+	out := s[:i]
+	s = s[i:]
+
+	end = true
+	for i, r = range s {
+		if !unicode.IsSpace(r) {
+			end = false
+			break
+		}
+	}
+	if end { i = len(s) }
+	s = s[i:]
+
+	return out, s
+}
@@ -0,0 +1,1830 @@
+package respin
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func Test_trailers(t *testing.T) {
+	msg := break_trailer{}.command(spelling{})
+	if msg != "break" {
+		t.Errorf("Unexpected value for break_trailer.command(): got %s, expected break", msg)
+	}
+
+	msg = exec_trailer{cmd: "ls -l"}.command(spelling{})
+	if msg != "exec ls -l" {
+		t.Errorf("Unexpected value for break_trailer.command(): got '%s', expected 'exec ls -l'", msg)
+	}
+
+	msg = update_ref_trailer{ref: "refs/heads/topic"}.command(spelling{})
+	if msg != "update-ref refs/heads/topic" {
+		t.Errorf("Unexpected value for update_ref_trailer.command(): got '%s', expected 'update-ref refs/heads/topic'", msg)
+	}
+}
+
+func Test_output_node(t *testing.T) {
+	var f func()
+	defer func(){
+		r := recover()
+		if r != nil { f() }
+	}()
+
+	head, tail := newList()
+	f = func() { t.Errorf("linked list creator helper is not properly initializing its contents! %p: %+v, %p: %+v", head, head, tail, tail) }
+
+	if head.next.prev.next != tail {
+		t.Errorf("linked list creator helper is not properly initializing its contents! %p: %+v, %p: %+v", head, head, tail, tail)
+	}
+
+	node := &output_node{}
+	head.insert_after(node)
+	f = func() { t.Errorf("node insertion is behaving strangely! %p: %+v, %p: %+v, %p: %+v", head, head, node, node, tail, tail) }
+
+	if head.next.next.prev.prev.next.next != tail {
+		t.Errorf("node insertion is behaving strangely! %p: %+v, %p: %+v, %p: %+v", head, head, node, node, tail, tail)
+	}
+}
+
+func Test_grab(t *testing.T) {
+	testcases := map[string]struct{
+		input, out1, out2 string
+	}{
+		"leading-space": {"    this is\t \na string withmanytokens\r", "this", "is\t \na string withmanytokens\r"},
+		"normal": {"this is\t \na string withmanytokens\r", "this", "is\t \na string withmanytokens\r"},
+		"end": {"token", "token", ""},
+		"trailing-space": {"token   ", "token", ""},
+	}
+
+	for k, v := range testcases {
+		t.Run(k, func(t *testing.T) {
+			out1, out2 := grab(v.input)
+			if out1 != v.out1 { t.Errorf("Unexpected token: got '%s', expected '%s'", out1, v.out1) }
+			if out2 != v.out2 { t.Errorf("Unexpected trailer: got '%s', expected '%s'", out2, v.out2) }
+		})
+	}
+}
+
+func Test_strip_fixup_squash(t *testing.T) {
+	testcases := map[string]struct {
+		in, out string
+	}{
+		"no-op": {"unchanged", "unchanged"},
+		"simple-fixup": {"fixup! changed", "changed"},
+		"simple-squash": {"squash! changed", "changed"},
+		"complex-multiple-weird-whitespace": {"\tfixup!     squash!\tchanged with some more words", "changed with some more words"},
+		"simple-amend": {"amend! changed", "changed"},
+		"amend-of-fixup": {"amend! fixup! changed", "changed"},
+	}
+
+	for k, v := range testcases {
+		t.Run(k, func(t *testing.T) {
+			out := strip_fixup_squash(v.in)
+
+			if v.out != out {
+				t.Errorf("Unexpected result: got %s, expected %s", out, v.out)
+			}
+		})
+	}
+}
+
+func Test_push(t *testing.T) {
+	testcases := map[string]struct {
+		inputs []string
+	}{
+		"normal": {[]string{"123", "456", "789"}},
+	}
+
+	for k, v := range testcases {
+		t.Run(k, func(t *testing.T) {
+			head, tail := newList()
+			for _, s := range v.inputs {
+				push(s, head)
+			}
+
+			i := 0
+			for node := tail.prev; node != head; node = node.prev {
+				if i >= len(v.inputs) {
+					t.Errorf("Out of range: %d (max %d)", i, len(v.inputs))
+					if i > 10 { break }
+				} else if node.line != v.inputs[i] {
+					t.Errorf("Unexpected value at position %d: got %s, expected %s", i, v.inputs[i], node.line)
+				}
+				i++
+			}
+
+			if i != len(v.inputs) {
+				t.Errorf("Wrong number of values: expected %d, got %d", len(v.inputs), i)
+			}
+		})
+	}
+}
+
+func Test_push_commit(t *testing.T) {
+	trailers := []trailer{nil, break_trailer{}, exec_trailer{cmd: "foo"}, exec_trailer{cmd: "bar"}}
+
+	testcases := map[string]struct {
+		inputs [][]string
+		t []trailer
+		conflicts int
+	}{
+		"duplicates": {[][]string{[]string{"1", "msg1", "111"}, []string{"2", "msg2", "222"}, []string{"3", "msg1", "333"}}, trailers[1:4], 1},
+		"several": {[][]string{[]string{"1", "msg1", "111"}, []string{"2", "msg2", "222"}, []string{"3", "msg3", "333"}}, trailers[0:3], 0},
+		"one": {[][]string{[]string{"1", "msg1", "111"}}, trailers[1:2], 0},
+	}
+
+	for k, v := range testcases {
+		t.Run(k, func(t *testing.T) {
+			cmap := make(map[string]*output_node)
+			hmap := make(map[string]*output_node)
+
+			head, tail := newList()
+			for i, s := range v.inputs {
+				push_commit(s[0], s[1], s[2], []trailer{v.t[i]}, head, cmap, hmap)
+			}
+
+			i := 0
+			for node := tail.prev; node != head; node = node.prev {
+				if i >= len(v.inputs) {
+					t.Errorf("Out of range: %d (max %d)", i, len(v.inputs))
+					if i > 10 { break }
+				} else {
+					if node.line != v.inputs[i][0] {
+						t.Errorf("Unexpected value at position %d: got %s, expected %s", i, v.inputs[i][0], node.line)
+					}
+					if node.trailers[0] != v.t[i] {
+						t.Errorf("Unexpected trailer at position %d: got %v, expected %v", i, v.t[i], node.trailers[i])
+					}
+				}
+				i++
+			}
+
+			if i - v.conflicts != len(cmap) {
+				t.Errorf("Wrong number of distinct commits: expected %d, got %d", i - v.conflicts, len(cmap))
+			}
+			if i != len(hmap) {
+				t.Errorf("Wrong number of distinct hashes: expected %d, got %d", i, len(hmap))
+			}
+
+			if i != len(v.inputs) {
+				t.Errorf("Wrong number of values: expected %d, got %d", len(v.inputs), i)
+			}
+
+			for _, x := range v.inputs {
+				if _, ok := hmap[x[2]]; !ok {
+					t.Errorf("Hash map has missing entry: %s", x[2])
+				}
+			}
+
+			for k, v := range cmap {
+				if k != v.msg {
+					t.Errorf("Commit message map has bad entry: %s -> %s", k, v.msg)
+				}
+			}
+		})
+	}
+}
+
+func Test_relocate_commit(t *testing.T) {
+	trailers := []trailer{nil, break_trailer{}, exec_trailer{cmd: "foo"}, exec_trailer{cmd: "bar"}}
+
+	testcases := map[string]struct {
+		input []output_node
+		output []output_node
+		expected_err string
+		cmap map[string]int
+		hmap map[string]int
+
+		line, msg, hash, after string
+		trailer trailer
+		write_out_index int
+	}{
+		"first-missing": {
+			[]output_node{},
+			[]output_node{output_node{}},
+			"",
+			map[string]int{}, map[string]int{},
+			"p 123 m1", "m1", "123", "", trailers[0], 0,
+		},
+		"second-collide": {
+			[]output_node{output_node{line: "p 123 test", msg: "test", trailers: trailers[0:1]}},
+			[]output_node{output_node{line: "p 123 test", msg: "test", trailers: trailers[0:1]}, output_node{}},
+			"",
+			map[string]int{"test": 0}, map[string]int{"123": 0},
+			"p 456 fixup! test", "fixup! test", "456", "", trailers[1], 1,
+		},
+		"middle-collide": {
+			[]output_node{output_node{line: "p 123 test", msg: "test", trailers: trailers[0:1]},
+			              output_node{line: "p 234 test2", msg: "test2", trailers: trailers[1:2]}},
+			[]output_node{output_node{line: "p 123 test", msg: "test", trailers: trailers[0:1]},
+			              output_node{},
+			              output_node{line: "p 234 test2", msg: "test2", trailers: trailers[1:2]}},
+			"",
+			map[string]int{"test": 0, "test2": 1}, map[string]int{"123": 0, "234": 1},
+			"p 456 fixup! test", "fixup! test", "456", "", trailers[2], 1,
+		},
+		"multi-fixup": {
+			[]output_node{output_node{line: "p 123 test", msg: "test", trailers: trailers[0:1]},
+			              output_node{line: "p 234 fixup! test", msg: "fixup! test", trailers: trailers[2:3]},
+			              output_node{line: "p 345 test2", msg: "test2", trailers: trailers[1:2]}},
+			[]output_node{output_node{line: "p 123 test", msg: "test", trailers: trailers[0:1]},
+			              output_node{line: "p 234 fixup! test", msg: "fixup! test", trailers: trailers[2:3]},
+			              output_node{},
+			              output_node{line: "p 345 test2", msg: "test2", trailers: trailers[1:2]}},
+			"",
+			map[string]int{"test": 1, "test2": 2}, map[string]int{"123": 0, "234": 1, "345": 2},
+			"p 456 fixup! test", "fixup! test", "456", "", trailers[3], 2,
+		},
+		"nested-fixup": {
+			[]output_node{output_node{line: "p 123 test", msg: "test", trailers: trailers[0:1]},
+			              output_node{line: "p 234 fixup! test", msg: "fixup! test", trailers: trailers[2:3]},
+			              output_node{line: "p 567 fixup! fixup! test", msg: "fixup! fixup! test", trailers: trailers[3:4]},
+			              output_node{line: "p 345 test2", msg: "test2", trailers: trailers[1:2]}},
+			[]output_node{output_node{line: "p 123 test", msg: "test", trailers: trailers[0:1]},
+			              output_node{line: "p 234 fixup! test", msg: "fixup! test", trailers: trailers[2:3]},
+			              output_node{line: "p 567 fixup! fixup! test", msg: "fixup! fixup! test", trailers: trailers[3:4]},
+			              output_node{},
+			              output_node{line: "p 345 test2", msg: "test2", trailers: trailers[1:2]}},
+			"",
+			map[string]int{"test": 2, "test2": 3}, map[string]int{"123": 0, "234": 1, "567": 2, "345": 3},
+			"p 456 fixup! test", "fixup! test", "456", "", trailers[3], 3,
+		},
+	}
+
+	for k, v := range testcases {
+		t.Run(k, func(t *testing.T) {
+			if v.write_out_index != -1 { v.output[v.write_out_index] = output_node{line: v.line, msg: v.msg, trailers: []trailer{v.trailer}} }
+
+			head, tail := newList()
+			for i := range v.input { head.insert_after(&v.input[i]) }
+
+			cmap := make(map[string]*output_node)
+			for k, vv := range v.cmap {
+				cmap[k] = &v.input[vv]
+			}
+			hmap := make(map[string]*output_node)
+			for k, vv := range v.hmap {
+				hmap[k] = &v.input[vv]
+			}
+
+			oldnode := cmap[strip_fixup_squash(v.msg)]
+			if _, ok := hmap[v.hash]; ok { t.Errorf("Hash present in map before starting! %s", v.hash) }
+			_, err := relocate_commit(v.line, v.msg, v.hash, v.after, []trailer{v.trailer}, head, cmap, hmap)
+
+			if err == nil && v.expected_err != "" || err != nil && (v.expected_err == "" || !strings.Contains(err.Error(), v.expected_err)) {
+				t.Errorf("Unexpected error: got '%v', wanted '%s'", err, v.expected_err)
+			}
+
+			if err != nil { return }
+
+			if oldnode == cmap[strip_fixup_squash(v.msg)] {
+				t.Errorf("Commit message map for %s was not updated!", v.msg)
+			}
+			if _, ok := hmap[v.hash]; !ok { t.Errorf("Hash not present in map after starting! %s", v.hash) }
+
+			i := 0
+			for node := tail.prev; node != head; node = node.prev {
+				if node.line != v.output[i].line { t.Errorf("Unexpected line at node %d: got %s, expected %s", i, node.line, v.output[i].line) }
+				if node.msg != v.output[i].msg { t.Errorf("Unexpected message at node %d: got %s, expected %s", i, node.msg, v.output[i].msg) }
+				if node.trailers[0] != v.output[i].trailers[0] { t.Errorf("Unexpected message at node %d: got %v, expected %v", i, node.trailers[0], v.output[i].trailers[0]) }
+				i++
+			}
+
+			if i != len(v.output) { t.Errorf("Wrong number of output nodes: got %d, expected %d", i, len(v.output)) }
+		})
+	}
+}
+
+func Test_readSettings(t *testing.T) {
+	testcases := map[string]struct{
+		input, output map[string]reaction
+		input_data string
+		expected_err string
+	}{
+		"individual": {
+			map[string]reaction{},
+			map[string]reaction{
+				"1111": reaction{mode: commands["pick"]},
+				"1113": reaction{mode: commands["pick"]},
+				"1141": reaction{mode: commands["reword"]},
+				"1143": reaction{mode: commands["reword"]},
+				"1151": reaction{mode: commands["edit"]},
+				"1153": reaction{mode: commands["edit"]},
+				"1121": reaction{mode: commands["fixup"]},
+				"1123": reaction{mode: commands["fixup"]},
+				"1125": reaction{mode: commands["fixup"], extra: "5555"},
+				"1127": reaction{mode: commands["fixup-C"]},
+				"1128": reaction{mode: commands["fixup-C"], extra: "5555"},
+				"1129": reaction{mode: commands["fixup-c"]},
+				"112a": reaction{mode: commands["fixup-c"]},
+				"1131": reaction{mode: commands["squash"]},
+				"1133": reaction{mode: commands["squash"]},
+				"1135": reaction{mode: commands["squash"], extra: "This is a string"},
+				"1161": reaction{mode: commands["drop"]},
+				"1163": reaction{mode: commands["drop"]},
+				"1171": reaction{mode: commands["override"], auxiliary: []trailer{exec_trailer{cmd: "./test.sh arg1"}}},
+				"1173": reaction{mode: commands["override"], auxiliary: []trailer{exec_trailer{cmd: "./test.sh arg3"}}},
+				"1181": reaction{mode: commands["override"], auxiliary: []trailer{break_trailer{}}},
+				"1183": reaction{mode: commands["override"], auxiliary: []trailer{break_trailer{}}},
+				"1191": reaction{mode: commands["override"], keep: true},
+				"1193": reaction{mode: commands["override"], keep: true},
+				"11a1": reaction{mode: commands["bubble"]},
+				"11a3": reaction{mode: commands["bubble"]},
+				"11b1": reaction{mode: commands["sink"]},
+				"11b3": reaction{mode: commands["sink"]},
+			},
+`
+pick     1111
+  p      1113
+reword   1141
+  r      1143
+edit     1151
+  e      1153
+fixup    1121
+  f      1123
+  f      1125 5555
+fixup-C  1127
+  f-C    1128 5555
+fixup-c  1129
+  f-c    112a
+squash   1131
+  s      1133
+  s      1135 This is a string
+drop     1161
+  d      1163
+exec     1171 ./test.sh arg1
+  x      1173 ./test.sh arg3
+break    1181
+  b      1183
+override 1191
+  o      1193
+bubble   11a1
+  u      11a3
+sink     11b1
+  k      11b3
+`, "",
+		},
+		"bad-command": {
+			map[string]reaction{},
+			map[string]reaction{},
+			"missing-command 1111", "Got a junk rebase command",
+		},
+		"missing-hash": {
+			map[string]reaction{},
+			map[string]reaction{},
+			"pick 1111\n  pick  \npick 1112", "Missing hash string",
+		},
+		"missing-exec-command": {
+			map[string]reaction{},
+			map[string]reaction{
+				"1111": reaction{mode: commands["pick"]},
+				"1112": reaction{mode: commands["pick"]},
+				"2222": reaction{mode: commands["override"], auxiliary: []trailer{exec_trailer{cmd: ""}}},
+			},
+			"pick 1111\n  exec 2222  \npick 1112", "",
+		},
+		"update-ref": {
+			map[string]reaction{},
+			map[string]reaction{
+				"1111": reaction{mode: commands["pick"], auxiliary: []trailer{update_ref_trailer{ref: "refs/heads/topic"}, exec_trailer{cmd: "make"}}},
+				"2222": reaction{auxiliary: []trailer{update_ref_trailer{ref: "refs/tags/v1"}}},
+				"refs/heads/old": reaction{mode: commands["drop-ref"]},
+				"refs/heads/older": reaction{mode: commands["drop-ref"]},
+			},
+			"pick 1111\nupdate-ref 1111 topic\nexec 1111 make\nupdate-ref 2222 refs/tags/v1\ndrop-ref old\ndrop-ref refs/heads/older", "",
+		},
+		"update-ref-missing-ref": {
+			map[string]reaction{},
+			map[string]reaction{},
+			"update-ref 1111", "Missing ref name",
+		},
+		"update-ref-default": {
+			map[string]reaction{},
+			map[string]reaction{},
+			"update-ref default topic", "Can't put refs/heads/topic after every commit",
+		},
+		"update-ref-twice": {
+			map[string]reaction{},
+			map[string]reaction{},
+			"update-ref 1111 topic\nupdate-ref 2222 refs/heads/topic", "Ref refs/heads/topic is already placed",
+		},
+		"todo-only-command": {
+			map[string]reaction{},
+			map[string]reaction{},
+			"pick 1111\nlabel 2222", "Can't use label as an instruction",
+		},
+		"stack-everything-up": {
+			map[string]reaction{},
+			map[string]reaction{
+				"1111": reaction{mode: commands["squash"], auxiliary: []trailer{
+					exec_trailer{cmd: "./foobar"},
+					break_trailer{},
+					exec_trailer{cmd: "./foobar2"},
+					break_trailer{},
+				}},
+			},
+`
+pick 1111
+reword 1111
+edit 1111
+bubble 1111
+fixup 1111
+squash 1111 extraaaa
+drop 1111
+exec 1111 ./foobar
+break 1111
+exec 1111 ./foobar2
+break 1111
+squash 1111
+`, "",
+		},
+	}
+
+	for k, v := range testcases {
+		t.Run(k, func(t *testing.T) {
+			p := NewPlan()
+			p.config = v.input
+			err := readSettings(p, bufio.NewScanner(strings.NewReader(v.input_data)))
+			out := p.config
+
+			if err == nil && v.expected_err != "" || err != nil && (v.expected_err == "" || !strings.Contains(err.Error(), v.expected_err)) {
+				t.Errorf("Unexpected error: got '%v', wanted '%s'", err, v.expected_err)
+			}
+
+			if err != nil { return }
+
+			if !reflect.DeepEqual(v.output, out) { t.Errorf("Unexpected result: got:\n%v\n\n, expected:\n%v\n\n", out, v.output) }
+		})
+	}
+}
+
+func Test_readSettingsJSON(t *testing.T) {
+	testcases := map[string]struct{
+		output map[string]reaction
+		input_data string
+		expected_err string
+	}{
+		"everything": {
+			map[string]reaction{
+				"default": reaction{mode: commands["squash"], auxiliary: []trailer{exec_trailer{cmd: "make test"}}},
+				"1111": reaction{mode: commands["pick"]},
+				"1112": reaction{mode: commands["fixup"], extra: "1111"},
+				"1113": reaction{auxiliary: []trailer{exec_trailer{cmd: "echo \"it's\" $HOME 'done'"}, break_trailer{}, update_ref_trailer{ref: "refs/heads/topic"}}},
+			},
+`[
+	{"action": "squash", "commit": "default", "trailers": [{"action": "exec", "args": "make test"}]},
+	{"action": "pick", "commit": "1111"},
+	{"action": "f", "commit": "1112", "args": "1111"},
+	{"commit": "1113", "trailers": [
+		{"action": "x", "args": "echo \"it's\" $HOME 'done'"},
+		{"action": "break"},
+		{"action": "update-ref", "args": "topic"}
+	]}
+]`, "",
+		},
+		"empty": {map[string]reaction{}, "[]", ""},
+		"not-an-array": {nil, `{"action": "pick"}`, "$: expected an array of instructions"},
+		"not-an-object": {nil, `[{"action": "pick", "commit": "1111"}, "pick 1112"]`, "$[1]: expected an object"},
+		"unknown-field": {nil, `[{"action": "pick", "commit": "1111", "hash": "1112"}]`, "$[0].hash: unknown field"},
+		"wrong-type": {nil, `[{"action": "pick", "commit": 1111}]`, "$[0].commit: expected string, got number"},
+		"missing-commit": {nil, `[{"action": "pick"}]`, "$[0].commit: Missing hash string"},
+		"missing-action": {nil, `[{"commit": "1111"}]`, "$[0]: Missing action or trailers"},
+		"bad-action": {nil, `[{"action": "pick", "commit": "1111"}, {"action": "frobnicate", "commit": "1111"}]`, "$[1].action: Got a junk rebase command: frobnicate"},
+		"bad-trailer": {nil, `[{"commit": "1111", "trailers": [{"action": "break"}, {"action": "drop"}]}]`, "$[0].trailers[1].action: expected exec, break or update-ref"},
+		"bad-trailer-field": {nil, `[{"commit": "1111", "trailers": [{"action": "exec", "cmd": "ls"}]}]`, "$[0].trailers[0].cmd: unknown field"},
+		"ref-twice": {nil, `[{"action": "update-ref", "commit": "1111", "args": "a"}, {"commit": "1112", "trailers": [{"action": "update-ref", "args": "a"}]}]`, "1:59: $[1].trailers[0].args: Ref refs/heads/a is already placed by update-ref 1111 a at 1:2"},
+		"bad-pattern": {nil, `[{"action": "drop", "commit": "/[/"}]`, "$[0].commit: Bad subject pattern"},
+		"bad-direction": {nil, `[{"action": "move", "commit": "1111", "args": "under 1112"}]`, "$[0].args: Expected after or before"},
+		"trailer-commit": {nil, `[{"commit": "/^a/", "trailers": [{"action": "update-ref", "args": "a"}]}]`, "$[0].commit: Can't use update-ref with a subject selector"},
+	}
+
+	for k, v := range testcases {
+		t.Run(k, func(t *testing.T) {
+			p := NewPlan()
+			err := readSettingsJSON(p, strings.NewReader(v.input_data))
+			out := p.config
+
+			if err == nil && v.expected_err != "" || err != nil && (v.expected_err == "" || !strings.Contains(err.Error(), v.expected_err)) {
+				t.Errorf("Unexpected error: got '%v', wanted '%s'", err, v.expected_err)
+			}
+
+			if err != nil { return }
+
+			if !reflect.DeepEqual(v.output, out) { t.Errorf("Unexpected result: got:\n%v\n\n, expected:\n%v\n\n", out, v.output) }
+		})
+	}
+}
+
+func str(h, t *output_node) string {
+	var b bytes.Buffer
+	for n := h.next; n != t; n = n.next { b.WriteString(fmt.Sprintf("%+v\n", n)) }
+	return b.String()
+}
+
+func Test_parseInput(t *testing.T) {
+	testcases := map[string]struct {
+		input map[string]reaction
+		input_data string
+
+		expected_err string
+		output []output_node
+	}{
+		"simple": {
+			map[string]reaction{
+				"1111": reaction{mode: commands["drop"]},
+			}, "pick 2222 m1\npick 1111 m2\npick 3333 m3\n", "", []output_node{
+				output_node{line: "pick 2222 m1", msg: "m1"},
+				output_node{line: "drop 1111 m2", msg: "m2"},
+				output_node{line: "pick 3333 m3", msg: "m3"},
+			},
+		},
+		"default": {
+			map[string]reaction{
+				"default": reaction{mode:commands["drop"]},
+				"1111": reaction{mode: commands["pick"]},
+			}, "pick 2222 m1\npick 1111 m2\npick 3333 m3\n", "", []output_node{
+				output_node{line: "drop 2222 m1", msg: "m1"},
+				output_node{line: "pick 1111 m2", msg: "m2"},
+				output_node{line: "drop 3333 m3", msg: "m3"},
+			},
+		},
+		"default-exec": {
+			map[string]reaction{
+				"default": reaction{mode:commands["override"], auxiliary: []trailer{exec_trailer{cmd: "./foobar.sh"}}},
+				"1111": reaction{mode: commands["edit"]},
+			}, "pick 2222 m1\npick 1111 m2\npick 3333 m3\n", "", []output_node{
+				output_node{line: "pick 2222 m1", msg: "m1", trailers: []trailer{exec_trailer{cmd: "./foobar.sh"}}},
+				output_node{line: "edit 1111 m2", msg: "m2", trailers: []trailer{exec_trailer{cmd: "./foobar.sh"}}},
+				output_node{line: "pick 3333 m3", msg: "m3", trailers: []trailer{exec_trailer{cmd: "./foobar.sh"}}},
+			},
+		},
+		"fixup-squash": {
+			map[string]reaction{
+				"7777": reaction{mode: commands["fixup"]},
+				"8888": reaction{mode: commands["squash"]},
+			}, "pick 2222 m1\npick 1111 m2\npick 3333 m3\npick 7777 fixup! m1\npick 8888 squash! m2", "", []output_node{
+				output_node{line: "pick 2222 m1", msg: "m1"},
+				output_node{line: "fixup 7777 fixup! m1", msg: "fixup! m1"},
+				output_node{line: "pick 1111 m2", msg: "m2"},
+				output_node{line: "squash 8888 squash! m2", msg: "squash! m2"},
+				output_node{line: "pick 3333 m3", msg: "m3"},
+			},
+		},
+		"multi-fixup-squash": {
+			map[string]reaction{
+				"444": reaction{mode: commands["fixup"]},
+				"555": reaction{mode: commands["squash"]},
+				"666": reaction{mode: commands["fixup"]},
+				"777": reaction{mode: commands["fixup"]},
+				"888": reaction{mode: commands["squash"]},
+			}, "pick 111 m1\npick 222 m2\npick 333 m3\npick 444 fixup! m1\npick 555 squash! m1\npick 666 fixup! fixup! m1\npick 777 fixup! m1\npick 888 squash! squash! m1", "", []output_node{
+				output_node{line: "pick 111 m1", msg: "m1"},
+				output_node{line: "fixup 444 fixup! m1", msg: "fixup! m1"},
+				output_node{line: "fixup 666 fixup! fixup! m1", msg: "fixup! fixup! m1"},
+				output_node{line: "squash 555 squash! m1", msg: "squash! m1"},
+				output_node{line: "squash 888 squash! squash! m1", msg: "squash! squash! m1"},
+				output_node{line: "fixup 777 fixup! m1", msg: "fixup! m1"},
+				output_node{line: "pick 222 m2", msg: "m2"},
+				output_node{line: "pick 333 m3", msg: "m3"},
+			},
+		},
+		"incoming-no-relocate": {
+			map[string]reaction{
+			}, "pick 111 m1\npick 222 m2\nfixup 333 fixup! m1\npick 444 m4", "", []output_node{
+				output_node{line: "pick 111 m1", msg: "m1"},
+				output_node{line: "pick 222 m2", msg: "m2"},
+				output_node{line: "fixup 333 fixup! m1", msg: "fixup! m1"},
+				output_node{line: "pick 444 m4", msg: "m4"},
+			},
+		},
+		"incoming-yes-relocate": {
+			map[string]reaction{
+				"333": reaction{mode: commands["fixup"]},
+			}, "pick 111 m1\npick 222 m2\npick 333 fixup! m1\npick 444 m4", "", []output_node{
+				output_node{line: "pick 111 m1", msg: "m1"},
+				output_node{line: "fixup 333 fixup! m1", msg: "fixup! m1"},
+				output_node{line: "pick 222 m2", msg: "m2"},
+				output_node{line: "pick 444 m4", msg: "m4"},
+			},
+		},
+		"incoming-follow-relocate": {
+			map[string]reaction{
+				"333": reaction{mode: commands["fixup"]},
+			}, "pick 111 m1\npick 222 m2\npick 333 fixup! m1\nfixup 444 m4", "", []output_node{
+				output_node{line: "pick 111 m1", msg: "m1"},
+				output_node{line: "fixup 333 fixup! m1", msg: "fixup! m1"},
+				output_node{line: "fixup 444 m4", msg: "m4"},
+				output_node{line: "pick 222 m2", msg: "m2"},
+			},
+		},
+		"directed-relocate": {
+			map[string]reaction{
+				"333": reaction{mode: commands["fixup"], extra: "m1"},
+				"444": reaction{mode: commands["fixup"], extra: "111"},
+				"666": reaction{mode: commands["fixup"], extra: "111"},
+			}, "pick 111 m1\npick 222 m2\npick 333 m3\npick 444 m4\npick 555 m5\nfixup 666 m6", "", []output_node{
+				output_node{line: "pick 111 m1", msg: "m1"},
+				output_node{line: "fixup 666 m6", msg: "m6"},
+				output_node{line: "fixup 444 m4", msg: "m4"},
+				output_node{line: "fixup 333 m3", msg: "m3"},
+				output_node{line: "pick 222 m2", msg: "m2"},
+				output_node{line: "pick 555 m5", msg: "m5"},
+			},
+		},
+		"bubble-compound-relocate": {
+			map[string]reaction{
+				"aaa": reaction{mode: commands["bubble"]},
+				"bbb": reaction{mode: commands["bubble"]},
+				"ccc": reaction{mode: commands["bubble"]},
+				"ddd": reaction{mode: commands["squash"]},
+			}, "pick aaa b1\npick 111 m1\npick 222 m2\npick bbb b2\npick ddd squash! b1\npick 333 m3\npick 444 m4\npick ccc b3\nfixup 666 m6\npick 555 m5", "", []output_node{
+				output_node{line: "pick 111 m1", msg: "m1"},
+				output_node{line: "pick 222 m2", msg: "m2"},
+				output_node{line: "pick 333 m3", msg: "m3"},
+				output_node{line: "pick 444 m4", msg: "m4"},
+				output_node{line: "pick 555 m5", msg: "m5"},
+				output_node{line: "pick aaa b1", msg: "b1"},
+				output_node{line: "squash ddd squash! b1", msg: "squash! b1"},
+				output_node{line: "pick bbb b2", msg: "b2"},
+				output_node{line: "pick ccc b3", msg: "b3"},
+				output_node{line: "fixup 666 m6", msg: "m6"},
+			},
+		},
+		"fixup-options": {
+			map[string]reaction{
+				"333": reaction{mode: commands["fixup-C"], extra: "111"},
+				"444": reaction{mode: commands["drop"]},
+				"555": reaction{mode: commands["fixup-c"], extra: "222"},
+				"666": reaction{mode: commands["squash"]},
+			}, "pick 111 m1\npick 222 m2\nfixup -C 777 amend! m2\npick 333 m3\nfixup -c 444 m4\npick 555 m5\nf -C 666 amend! m5\nf -c 888 m8", "", []output_node{
+				output_node{line: "pick 111 m1", msg: "m1"},
+				output_node{line: "fixup -C 333 m3", msg: "m3"},
+				output_node{line: "pick 222 m2", msg: "m2"},
+				output_node{line: "fixup -c 555 m5", msg: "m5"},
+				output_node{line: "squash 666 amend! m5", msg: "amend! m5"},
+				output_node{line: "f -c 888 m8", msg: "m8"},
+				output_node{line: "fixup -C 777 amend! m2", msg: "amend! m2"},
+				output_node{line: "drop 444 m4", msg: "m4"},
+			},
+		},
+		"rebase-merges": {
+			map[string]reaction{
+				"default": reaction{mode: commands["drop"]},
+				"111": reaction{mode: commands["pick"]},
+				"222": reaction{mode: commands["bubble"]},
+				"333": reaction{mode: commands["pick"]},
+				"999": reaction{mode: commands["reword"], auxiliary: []trailer{exec_trailer{cmd: "make"}}},
+			}, "label onto\n\nreset onto\npick 111 m1\npick 222 m2\nlabel topic\nreset onto\npick 333 m3\nmerge -C 999 topic # Merge branch 'topic'\nmerge -C 888 other # Merge branch 'other'\nmerge other2", "", []output_node{
+				output_node{line: "label onto"},
+				output_node{line: ""},
+				output_node{line: "reset onto"},
+				output_node{line: "pick 111 m1", msg: "m1"},
+				output_node{line: "label topic"},
+				output_node{line: "reset onto"},
+				output_node{line: "pick 333 m3", msg: "m3"},
+				output_node{line: "merge -c 999 topic # Merge branch 'topic'", msg: "Merge branch 'topic'", trailers: []trailer{exec_trailer{cmd: "make"}}},
+				output_node{line: "drop 888 other # Merge branch 'other'", msg: "Merge branch 'other'"},
+				output_node{line: "merge other2"},
+				output_node{line: "pick 222 m2", msg: "m2"},
+			},
+		},
+		"rebase-merges-fixup-target": {
+			map[string]reaction{
+				"222": reaction{mode: commands["squash"]},
+				"333": reaction{mode: commands["fixup"], extra: "999"},
+			}, "label onto\nreset onto\npick 111 m1\nlabel topic\nmerge -C 999 topic # Merge\nfixup 222 m2\npick 333 m3", "", []output_node{
+				output_node{line: "label onto"},
+				output_node{line: "reset onto"},
+				output_node{line: "pick 111 m1", msg: "m1"},
+				output_node{line: "label topic"},
+				output_node{line: "merge -C 999 topic # Merge", msg: "Merge"},
+				output_node{line: "fixup 333 m3", msg: "m3"},
+				output_node{line: "squash 222 m2", msg: "m2"},
+			},
+		},
+		"rebase-merges-fold-after-reset": {
+			map[string]reaction{
+				"default": reaction{mode: commands["squash"]},
+			}, "label onto\nreset onto\npick 111 m1\npick 222 m2", "3:1: Can't apply fixup (there is no commit before it)", nil,
+		},
+		"rebase-merges-fold-after-label": {
+			map[string]reaction{}, "pick 111 m1\nlabel topic\nfixup 222 m2", "3:1: Can't apply fixup (there is no commit before it)", nil,
+		},
+		"update-ref-follows-commit": {
+			map[string]reaction{
+				"111": reaction{mode: commands["bubble"]},
+				"333": reaction{mode: commands["fixup"], extra: "222"},
+			}, "pick 111 m1\nupdate-ref refs/heads/a\npick 222 m2\npick 333 m3\nu refs/heads/b\n\nupdate-ref refs/heads/c\npick 444 m4", "", []output_node{
+				output_node{line: "pick 222 m2", msg: "m2", trailers: []trailer{update_ref_trailer{ref: "refs/heads/b", line: "u refs/heads/b"}}},
+				output_node{line: "fixup 333 m3", msg: "m3"},
+				output_node{line: ""},
+				output_node{line: "update-ref refs/heads/c"},
+				output_node{line: "pick 444 m4", msg: "m4"},
+				output_node{line: "pick 111 m1", msg: "m1", trailers: []trailer{update_ref_trailer{ref: "refs/heads/a", line: "update-ref refs/heads/a"}}},
+			},
+		},
+		"update-ref-instructions": {
+			map[string]reaction{
+				"default": reaction{auxiliary: []trailer{exec_trailer{cmd: "make"}}},
+				"111": reaction{auxiliary: []trailer{update_ref_trailer{ref: "refs/heads/b"}}},
+				"refs/heads/c": reaction{mode: commands["drop-ref"]},
+			}, "reset onto\nupdate-ref refs/heads/x\npick 111 m1\nupdate-ref refs/heads/a\npick 222 m2\nupdate-ref refs/heads/b\nupdate-ref refs/heads/c", "", []output_node{
+				output_node{line: "reset onto"},
+				output_node{line: "update-ref refs/heads/x"},
+				output_node{line: "pick 111 m1", msg: "m1", trailers: []trailer{exec_trailer{cmd: "make"}, update_ref_trailer{ref: "refs/heads/b"}, update_ref_trailer{ref: "refs/heads/a", line: "update-ref refs/heads/a"}}},
+				output_node{line: "pick 222 m2", msg: "m2", trailers: []trailer{exec_trailer{cmd: "make"}}},
+			},
+		},
+		"sink-compound-relocate": {
+			map[string]reaction{
+				"aaa": reaction{mode: commands["sink"]},
+				"bbb": reaction{mode: commands["bubble"]},
+				"ccc": reaction{mode: commands["sink"], auxiliary: []trailer{break_trailer{}}},
+				"ddd": reaction{mode: commands["squash"]},
+			}, "pick 111 m1\npick aaa s1\npick 222 m2\npick bbb b2\npick ddd squash! s1\npick ccc s3\nfixup 666 m6\npick 555 m5", "", []output_node{
+				output_node{line: "pick 111 m1", msg: "m1"},
+				output_node{line: "pick 222 m2", msg: "m2"},
+				output_node{line: "pick 555 m5", msg: "m5"},
+				output_node{line: "pick bbb b2", msg: "b2"},
+				output_node{line: "pick aaa s1", msg: "s1"},
+				output_node{line: "squash ddd squash! s1", msg: "squash! s1"},
+				output_node{line: "pick ccc s3", msg: "s3", trailers: []trailer{break_trailer{}}},
+				output_node{line: "fixup 666 m6", msg: "m6"},
+			},
+		},
+		"sink-only": {
+			map[string]reaction{
+				"default": reaction{mode: commands["sink"]},
+			}, "pick 111 m1\npick 222 m2", "", []output_node{
+				output_node{line: "pick 111 m1", msg: "m1"},
+				output_node{line: "pick 222 m2", msg: "m2"},
+			},
+		},
+		"rebase-merges-bad-merge-reaction": {
+			map[string]reaction{
+				"999": reaction{mode: commands["squash"]},
+			}, "label onto\nreset onto\npick 111 m1\nmerge -C 999 topic # Merge", "Can't squash a merge commit", nil,
+		},
+	}
+
+	for k, v := range testcases {
+		t.Run(k, func(t *testing.T) {
+			expected_head, expected_tail := newList()
+			for i := range v.output { expected_head.insert_after(&v.output[i]) }
+
+			p := NewPlan()
+			p.config = v.input
+			todo, err := Parse(strings.NewReader(v.input_data))
+			if err != nil { t.Fatalf("Unexpected error: %s", err) }
+			head, tail, err := parseInput(p, new_tracker(), todo)
+
+			if err == nil && v.expected_err != "" || err != nil && (v.expected_err == "" || !strings.Contains(err.Error(), v.expected_err)) {
+				t.Errorf("Unexpected error: got '%v', wanted '%s'", err, v.expected_err)
+			}
+
+			if err != nil { return }
+
+			if !reflect.DeepEqual(head, expected_head) { t.Errorf("Unexpected result: got:\n%s\n, expected:\n%v\n", str(head, tail), str(expected_head, expected_tail)) }
+		})
+	}
+}
+
+func Test_listTodo(t *testing.T) {
+	head, tail := newList()
+	head.insert_after(&output_node{line: "pick 111 m1", trailers: []trailer{exec_trailer{cmd: "make"}, break_trailer{}}})
+	head.insert_after(&output_node{line: "# a comment"})
+	head.insert_after(&output_node{line: "fixup 222 m2"})
+
+	var b bytes.Buffer
+	if err := Format(&b, listTodo(head, tail, "\r\n", spelling{}, "#")); err != nil { t.Errorf("Unexpected error: %s", err) }
+
+	expected := "pick 111 m1\r\nexec make\r\nbreak\r\n# a comment\r\nfixup 222 m2\r\n"
+	if b.String() != expected { t.Errorf("Unexpected output: got:\n%q\nexpected:\n%q", b.String(), expected) }
+}
+
+func Test_Parse_Format(t *testing.T) {
+	testcases := map[string]struct {
+		input string
+		lines []Line
+	}{
+		"empty": {"", nil},
+		"normal": {"pick 111 m1\n# comment\n\n", []Line{{"pick 111 m1", "\n"}, {"# comment", "\n"}, {"", "\n"}}},
+		"no-final-newline": {"pick 111 m1\npick 222 m2", []Line{{"pick 111 m1", "\n"}, {"pick 222 m2", ""}}},
+		"mixed-endings": {"pick 111 m1\r\npick 222 m2\n\r\n\r", []Line{{"pick 111 m1", "\r\n"}, {"pick 222 m2", "\n"}, {"", "\r\n"}, {"\r", ""}}},
+		"odd-whitespace": {"  pick\t111   m1  \n", []Line{{"  pick\t111   m1  ", "\n"}}},
+	}
+
+	for k, v := range testcases {
+		t.Run(k, func(t *testing.T) {
+			todo, err := Parse(strings.NewReader(v.input))
+			if err != nil { t.Fatalf("Unexpected error: %s", err) }
+			if !reflect.DeepEqual(todo.Lines, v.lines) { t.Errorf("Unexpected lines: got %q, expected %q", todo.Lines, v.lines) }
+
+			var b bytes.Buffer
+			if err := Format(&b, todo); err != nil { t.Fatalf("Unexpected error: %s", err) }
+			if b.String() != v.input { t.Errorf("Round trip changed the todo: got %q, expected %q", b.String(), v.input) }
+		})
+	}
+}
+
+func Test_Apply(t *testing.T) {
+	p := NewPlan()
+	for _, i := range []Instruction{
+		{Action: "exec", Commit: "default", Args: "make"},
+		{Action: "fixup", Commit: "333", Args: "111"},
+		{Action: "drop", Commit: "222"},
+	} {
+		if err := p.Add(i); err != nil { t.Fatalf("Unexpected error: %s", err) }
+	}
+	if err := p.Read(strings.NewReader("reword 444\n")); err != nil { t.Fatalf("Unexpected error: %s", err) }
+	if err := p.ReadJSON(strings.NewReader(`[{"commit": "444", "trailers": [{"action": "break"}]}]`)); err != nil { t.Fatalf("Unexpected error: %s", err) }
+
+	todo, err := Parse(strings.NewReader("pick 111 m1\r\npick 222 m2\r\npick 333 m3\r\n# comment\r\npick 444 m4"))
+	if err != nil { t.Fatalf("Unexpected error: %s", err) }
+	before := fmt.Sprintf("%v", todo)
+
+	res, err := Apply(p, todo)
+	if err != nil { t.Fatalf("Unexpected error: %s", err) }
+	if fmt.Sprintf("%v", todo) != before { t.Errorf("Apply changed its input todo") }
+	if len(res.Unmatched) != 0 { t.Errorf("Unexpected unmatched instructions: %v", res.Unmatched) }
+
+	var b bytes.Buffer
+	Format(&b, res.Todo)
+	expected := "pick 111 m1\r\nexec make\r\nfixup 333 m3\r\nexec make\r\ndrop 222 m2\r\nexec make\r\n# comment\r\nreword 444 m4\r\nexec make\r\nbreak"
+	if b.String() != expected { t.Errorf("Unexpected result: got:\n%q\nexpected:\n%q", b.String(), expected) }
+
+	if err := p.Add(Instruction{Action: "update-ref", Commit: "111", Args: "a"}); err != nil { t.Fatalf("Unexpected error: %s", err) }
+	err = p.Add(Instruction{Action: "update-ref", Commit: "222", Args: "a"})
+	if err == nil || !strings.Contains(err.Error(), "Ref refs/heads/a is already placed by update-ref 111 a") { t.Errorf("Unexpected error: got '%v'", err) }
+}
+
+func Test_writeDiff(t *testing.T) {
+	testcases := map[string]struct {
+		a, b string
+		expected string
+	}{
+		"same": {"1 2 3", "1 2 3", ""},
+		"empty-to-something": {"", "1 2", "--- a\n+++ b\n@@ -0,0 +1,2 @@\n+1\n+2\n"},
+		"something-to-empty": {"1", "", "--- a\n+++ b\n@@ -1 +0,0 @@\n-1\n"},
+		"middle": {"1 2 3 4 5 6 7", "1 2 3 x 5 6 7", "--- a\n+++ b\n@@ -2,5 +2,5 @@\n 2\n 3\n-4\n+x\n 5\n 6\n"},
+		"two-hunks": {"1 2 3 4 5 6 7 8 9", "x 2 3 4 5 6 7 8 y", "--- a\n+++ b\n@@ -1,3 +1,3 @@\n-1\n+x\n 2\n 3\n@@ -7,3 +7,3 @@\n 7\n 8\n-9\n+y\n"},
+		"merged-hunks": {"1 2 3 4 5 6", "x 2 3 4 5 y", "--- a\n+++ b\n@@ -1,6 +1,6 @@\n-1\n+x\n 2\n 3\n 4\n 5\n-6\n+y\n"},
+		"barely-split-hunks": {"1 2 3 4 5 6 7", "x 2 3 4 5 6 y", "--- a\n+++ b\n@@ -1,3 +1,3 @@\n-1\n+x\n 2\n 3\n@@ -5,3 +5,3 @@\n 5\n 6\n-7\n+y\n"},
+		"move": {"1 2 3", "2 3 1", "--- a\n+++ b\n@@ -1,3 +1,3 @@\n-1\n 2\n 3\n+1\n"},
+	}
+
+	for k, v := range testcases {
+		t.Run(k, func(t *testing.T) {
+			var b bytes.Buffer
+			writeDiff(&b, "a", "b", strings.Fields(v.a), strings.Fields(v.b), 2)
+			if b.String() != v.expected { t.Errorf("Unexpected diff: got:\n%s\nexpected:\n%s", b.String(), v.expected) }
+		})
+	}
+}
+
+func Test_summarize(t *testing.T) {
+	testcases := map[string]struct {
+		before, after string
+		expected Summary
+	}{
+		"nothing": {"pick 111 m1\npick 222 m2", "pick 111 m1\npick 222 m2", Summary{}},
+		"commands": {"pick 111 m1\npick 222 m2\nfixup -C 333 m3", "drop 111 m1\npick 222 m2\nfixup -c 333 m3", Summary{Changed: 2}},
+		"moved": {"pick 111 m1\npick 222 m2\npick 333 m3\npick 444 m4", "pick 222 m2\npick 333 m3\npick 111 m1\npick 444 m4", Summary{Moved: 1}},
+		"trailers": {"pick 111 m1\nexec a\npick 222 m2\npick 333 m3", "pick 111 m1\nexec a\npick 222 m2\nbreak\npick 333 m3\nx b\nexec c", Summary{Trailed: 2}},
+		"merges": {"label onto\nmerge -C 111 topic # m1\nupdate-ref refs/heads/x", "label onto\nmerge -c 111 topic # m1\nu refs/heads/x\nexec a", Summary{Changed: 1, Trailed: 1}},
+	}
+
+	for k, v := range testcases {
+		t.Run(k, func(t *testing.T) {
+			out := summarize(strings.Split(v.before, "\n"), strings.Split(v.after, "\n"), "#")
+			if out != v.expected { t.Errorf("Unexpected Summary: got %+v, expected %+v", out, v.expected) }
+		})
+	}
+}
+
+// apply runs a plan, written as an instruction file, against a todo, and returns the result.
+func apply(instructions, todo string) (string, error) {
+	p := NewPlan()
+	if err := p.Read(strings.NewReader(instructions)); err != nil { return "", err }
+
+	in, err := Parse(strings.NewReader(todo))
+	if err != nil { return "", err }
+
+	res, err := Apply(p, in)
+	if err != nil { return "", err }
+
+	var b bytes.Buffer
+	err = Format(&b, res.Todo)
+	return b.String(), err
+}
+
+func Test_grab_selector(t *testing.T) {
+	testcases := map[string]struct{
+		input, out1, out2 string
+	}{
+		"hash": {"  1111 extra args", "1111", "extra args"},
+		"regex": {"/^WIP: a b/ extra", "/^WIP: a b/", "extra"},
+		"regex-escaped": {` /a\/b c/ extra`, `/a\/b c/`, "extra"},
+		"regex-unterminated": {"/a b", "/a", "b"},
+		"quoted": {`msg:"temp debug" extra`, `msg:"temp debug"`, "extra"},
+		"quoted-escaped": {`msg:"say \"hi there\"" extra`, `msg:"say \"hi there\""`, "extra"},
+		"unquoted": {`msg:temp debug`, `msg:temp`, "debug"},
+	}
+
+	for k, v := range testcases {
+		t.Run(k, func(t *testing.T) {
+			out1, out2 := grab_selector(v.input)
+			if out1 != v.out1 { t.Errorf("Unexpected token: got '%s', expected '%s'", out1, v.out1) }
+			if out2 != v.out2 { t.Errorf("Unexpected trailer: got '%s', expected '%s'", out2, v.out2) }
+		})
+	}
+}
+
+func Test_parse_selector(t *testing.T) {
+	testcases := map[string]struct{
+		key string
+		matches, misses []string
+		expected_err string
+	}{
+		"hash": {"1111", nil, nil, ""},
+		"default": {"default", nil, nil, ""},
+		"regex": {"/^WIP/", []string{"WIP: stuff", "WIP"}, []string{"not WIP", "wip"}, ""},
+		"quoted": {`msg:"temp debug"`, []string{"add temp debug", "temp debug"}, []string{"temp  debug", "Temp debug"}, ""},
+		"unquoted": {"msg:temp", []string{"temp", "attempt"}, []string{"tmp"}, ""},
+		"range": {"111..222", nil, nil, ""},
+		"bad-range": {"111...222", nil, nil, "Bad range"},
+		"empty-range": {"..", nil, nil, "Empty range"},
+		"bad-regex": {"/(/", nil, nil, "Bad subject pattern"},
+		"unterminated-regex": {"/abc", nil, nil, "Unterminated subject pattern"},
+		"bad-quote": {`msg:"abc`, nil, nil, "Bad quoted subject"},
+		"empty": {`msg:""`, nil, nil, "Empty subject"},
+	}
+
+	for k, v := range testcases {
+		t.Run(k, func(t *testing.T) {
+			s, err := parse_selector(v.key)
+
+			if err == nil && v.expected_err != "" || err != nil && (v.expected_err == "" || !strings.Contains(err.Error(), v.expected_err)) {
+				t.Errorf("Unexpected error: got '%v', wanted '%s'", err, v.expected_err)
+			}
+
+			if err != nil { return }
+			if s == nil {
+				if v.matches != nil { t.Errorf("Not recognized as a selector: %s", v.key) }
+				return
+			}
+			if s.key != v.key { t.Errorf("Unexpected key: got '%s', expected '%s'", s.key, v.key) }
+			for _, m := range v.matches {
+				if !s.match(m) { t.Errorf("%s should match '%s'", v.key, m) }
+			}
+			for _, m := range v.misses {
+				if s.match(m) { t.Errorf("%s shouldn't match '%s'", v.key, m) }
+			}
+		})
+	}
+}
+
+func Test_selectors(t *testing.T) {
+	testcases := map[string]struct{
+		instructions, todo string
+		expected string
+		expected_err string
+	}{
+		"regex": {
+			"reword /^WIP/",
+			"pick 111 WIP: m1\npick 222 m2 WIP\npick 333 WIP m3\n",
+			"reword 111 WIP: m1\npick 222 m2 WIP\nreword 333 WIP m3\n", "",
+		},
+		"quoted": {
+			`drop msg:"temp debug"` + "\nexec msg:\"temp debug\" echo dropped",
+			"pick 111 add temp debug logging\npick 222 m2\n",
+			"drop 111 add temp debug logging\nexec echo dropped\npick 222 m2\n", "",
+		},
+		"precedence": {
+			"drop default\nreword /m/\nedit /[23]/\npick 333\nexec /m/ a\nexec default b\nexec 333 c",
+			"pick 111 m1\npick 222 m2\npick 333 m3\npick 444 x4\n",
+			"reword 111 m1\nexec b\nexec a\nedit 222 m2\nexec b\nexec a\npick 333 m3\nexec b\nexec a\nexec c\ndrop 444 x4\nexec b\n", "",
+		},
+		"trailers-only": {
+			"reword 222..444\nbreak 333\nreword /WIP/\nexec 111 make",
+			"pick 111 WIP m1\npick 222 m2\npick 333 m3\npick 444 m4\npick 555 m5\n",
+			"reword 111 WIP m1\nexec make\nreword 222 m2\nreword 333 m3\nbreak\nreword 444 m4\npick 555 m5\n", "",
+		},
+		"override": {
+			"reword /m/\noverride 222\nexec 222 make",
+			"pick 111 m1\npick 222 m2\n",
+			"reword 111 m1\npick 222 m2\nexec make\n", "",
+		},
+		"fixup-target": {
+			"fixup /^tidy/ 111",
+			"pick 111 m1\npick 222 m2\npick 333 tidy m1\n",
+			"pick 111 m1\nfixup 333 tidy m1\npick 222 m2\n", "",
+		},
+		"merge": {
+			"reword /^Merge/",
+			"label onto\nmerge -C 111 topic # Merge branch 'topic'\n",
+			"label onto\nmerge -c 111 topic # Merge branch 'topic'\n", "",
+		},
+		"range": {
+			"exec 222..444 make test\nsquash 555..\npick 555\nreword ..111",
+			"pick 111 m1\npick 222 m2\npick 333 m3\npick 444 m4\npick 555 m5\npick 666 m6\npick 777 m7\n",
+			"reword 111 m1\npick 222 m2\nexec make test\npick 333 m3\nexec make test\npick 444 m4\nexec make test\npick 555 m5\nsquash 666 m6\nsquash 777 m7\n", "",
+		},
+		"range-one": {
+			"drop 222..222",
+			"pick 111 m1\npick 222 m2\npick 333 m3\n",
+			"pick 111 m1\ndrop 222 m2\npick 333 m3\n", "",
+		},
+		"range-backward": {"drop 333..111", "pick 111 m1\npick 222 m2\npick 333 m3\n", "", "Bad range 333..111: 111 comes before 333 in the todo"},
+		"range-missing-start": {"drop 999..111", "pick 111 m1\npick 222 m2\n", "", "Bad range 999..111: 999 isn't in the todo"},
+		"range-missing-end": {"drop 111..999", "pick 111 m1\npick 222 m2\n", "", "Bad range 111..999: 999 isn't in the todo"},
+		"update-ref": {"update-ref /m/ topic", "", "", "Can't use update-ref with a subject selector"},
+		"bad-regex": {"pick /(/", "", "", "Bad subject pattern"},
+	}
+
+	for k, v := range testcases {
+		t.Run(k, func(t *testing.T) {
+			out, err := apply(v.instructions, v.todo)
+
+			if err == nil && v.expected_err != "" || err != nil && (v.expected_err == "" || !strings.Contains(err.Error(), v.expected_err)) {
+				t.Errorf("Unexpected error: got '%v', wanted '%s'", err, v.expected_err)
+			}
+
+			if err != nil { return }
+
+			if out != v.expected { t.Errorf("Unexpected result: got:\n%s\nexpected:\n%s", out, v.expected) }
+		})
+	}
+}
+
+func Test_moves(t *testing.T) {
+	testcases := map[string]struct{
+		instructions, todo string
+		expected string
+		expected_err string
+	}{
+		"after": {
+			"move 111 after 333",
+			"pick 111 m1\npick 222 m2\npick 333 m3\npick 444 m4\n",
+			"pick 222 m2\npick 333 m3\npick 111 m1\npick 444 m4\n", "",
+		},
+		"before": {
+			"move 444 before 222",
+			"pick 111 m1\npick 222 m2\npick 333 m3\npick 444 m4\n",
+			"pick 111 m1\npick 444 m4\npick 222 m2\npick 333 m3\n", "",
+		},
+		"before-fixup": {
+			"move 444 before 222\nmove 555 after 222",
+			"pick 111 m1\nfixup 222 m2\nsquash 333 m3\npick 444 m4\npick 555 m5\n",
+			"pick 444 m4\npick 111 m1\nfixup 222 m2\nsquash 333 m3\npick 555 m5\n", "",
+		},
+		"to-the-ends": {
+			"move 111 after 444\nmove 333 before 222\nmove 444 before 333",
+			"pick 111 m1\npick 222 m2\npick 333 m3\npick 444 m4\n",
+			"pick 444 m4\npick 333 m3\npick 222 m2\npick 111 m1\n", "",
+		},
+		"takes-fixups-and-trailers": {
+			"move 111 after 444\nexec 111 make\nfixup 555 111",
+			"pick 111 m1\nfixup 222 m2\nupdate-ref refs/heads/a\nsquash 333 m3\n# comment\npick 444 m4\nfixup 666 m6\npick 555 m5\n",
+			"# comment\npick 444 m4\nfixup 666 m6\npick 111 m1\nexec make\nfixup 555 m5\nfixup 222 m2\nupdate-ref refs/heads/a\nsquash 333 m3\n", "",
+		},
+		"keeps-command": {
+			"move 333 before 111\nreword 333\ndrop default",
+			"pick 111 m1\npick 222 m2\npick 333 m3\n",
+			"reword 333 m3\ndrop 111 m1\ndrop 222 m2\n", "",
+		},
+		"bubbled-target": {
+			"move 333 after 111\nbubble 111",
+			"pick 111 m1\npick 222 m2\npick 333 m3\npick 444 m4\n",
+			"pick 222 m2\npick 444 m4\npick 111 m1\npick 333 m3\n", "",
+		},
+		"sunk-target": {
+			"move 111 before 444\nsink 444",
+			"pick 111 m1\npick 222 m2\npick 333 m3\npick 444 m4\n",
+			"pick 222 m2\npick 333 m3\npick 111 m1\npick 444 m4\n", "",
+		},
+		"into-own-group": {"move 111 after 222", "pick 111 m1\nfixup 222 m2\n", "", "Can't move 111 after 222, which moves along with it"},
+		"missing-commit": {"move 111 after 999", "pick 111 m1\n", "", "commit is missing: 999"},
+		"merge": {"move 111 after 222", "pick 222 m2\nmerge -C 111 topic # m1\n", "", "merges can't be moved"},
+		"bad-where": {"move 111 behind 222", "", "", "Expected after or before, got 'behind'"},
+		"missing-target": {"move 111 after", "", "", "Missing hash string to move after"},
+		"itself": {"move 111 before 111", "", "", "Can't move 111 before itself"},
+		"default": {"move default after 111", "", "", "Can't move default"},
+	}
+
+	for k, v := range testcases {
+		t.Run(k, func(t *testing.T) {
+			out, err := apply(v.instructions, v.todo)
+
+			if err == nil && v.expected_err != "" || err != nil && (v.expected_err == "" || !strings.Contains(err.Error(), v.expected_err)) {
+				t.Errorf("Unexpected error: got '%v', wanted '%s'", err, v.expected_err)
+			}
+
+			if err != nil { return }
+
+			if out != v.expected { t.Errorf("Unexpected result: got:\n%s\nexpected:\n%s", out, v.expected) }
+		})
+	}
+}
+
+func Test_Unmatched(t *testing.T) {
+	p := NewPlan()
+	instructions := `
+drop default
+pick 111
+exec 999 make
+reword /^WIP/
+squash /^m/
+fixup 888 111
+move 222 after 111
+drop-ref topic
+drop-ref other
+update-ref 777 third
+`
+	if err := p.Read(strings.NewReader(instructions)); err != nil { t.Fatalf("Unexpected error: %s", err) }
+	if err := p.Add(Instruction{Action: "edit", Commit: "666"}); err != nil { t.Fatalf("Unexpected error: %s", err) }
+	if err := p.Add(Instruction{Action: "edit", Commit: "555"}); err != nil { t.Fatalf("Unexpected error: %s", err) }
+
+	todo, err := Parse(strings.NewReader("pick 111 m1\npick 222 m2\nupdate-ref refs/heads/topic\nupdate-ref refs/heads/third\n"))
+	if err != nil { t.Fatalf("Unexpected error: %s", err) }
+
+	res, err := Apply(p, todo)
+	if err != nil { t.Fatalf("Unexpected error: %s", err) }
+
+	expected := []Instruction{
+		{Action: "exec", Commit: "999", Args: "make", Pos: Position{Line: 4, Col: 1}},
+		{Action: "reword", Commit: "/^WIP/", Pos: Position{Line: 5, Col: 1}},
+		{Action: "fixup", Commit: "888", Args: "111", Pos: Position{Line: 7, Col: 1}},
+		{Action: "drop-ref", Commit: "refs/heads/other", Pos: Position{Line: 10, Col: 1}},
+		{Action: "update-ref", Commit: "777", Args: "third", Pos: Position{Line: 11, Col: 1}},
+		{Action: "edit", Commit: "666"},
+		{Action: "edit", Commit: "555"},
+	}
+	if !reflect.DeepEqual(res.Unmatched, expected) { t.Errorf("Unexpected unmatched instructions: got:\n%v\nexpected:\n%v", res.Unmatched, expected) }
+
+	if s := expected[0].String(); s != "exec 999 make" { t.Errorf("Unexpected string for instruction: got '%s'", s) }
+	if s := expected[1].String(); s != "reword /^WIP/" { t.Errorf("Unexpected string for instruction: got '%s'", s) }
+}
+
+func Test_Conflicts(t *testing.T) {
+	at := func(action, commit, args string, line int) Instruction {
+		return Instruction{Action: action, Commit: commit, Args: args, Pos: Position{Line: line, Col: 1}}
+	}
+	instructions := `drop 111
+exec 111 make
+pick 111
+squash 222 111
+squash 222 111
+s 222 111
+squash 222 333
+drop /^WIP/
+pick /^WIP/
+move 444 after 111
+move 444 after  111
+move 444 before 111
+`
+	testcases := map[string]struct {
+		policy ConflictPolicy
+		expected []Conflict
+		expected_mode map[string]command
+		expected_moves []move
+		expected_err string
+	}{
+		"last-wins": {
+			LastWins,
+			[]Conflict{
+				{Kept: at("pick", "111", "", 3), Dropped: at("drop", "111", "", 1)},
+				{Kept: at("squash", "222", "333", 7), Dropped: at("squash", "222", "111", 4)},
+				{Kept: at("pick", "/^WIP/", "", 9), Dropped: at("drop", "/^WIP/", "", 8)},
+				{Kept: at("move", "444", "before 111", 12), Dropped: at("move", "444", "after 111", 10)},
+			},
+			map[string]command{"111": commands["pick"], "222": commands["squash"], "/^WIP/": commands["pick"]},
+			[]move{{hash: "444", target: "111", pos: Position{Line: 12, Col: 1}}},
+			"",
+		},
+		"first-wins": {
+			FirstWins,
+			[]Conflict{
+				{Kept: at("drop", "111", "", 1), Dropped: at("pick", "111", "", 3)},
+				{Kept: at("squash", "222", "111", 4), Dropped: at("squash", "222", "333", 7)},
+				{Kept: at("drop", "/^WIP/", "", 8), Dropped: at("pick", "/^WIP/", "", 9)},
+				{Kept: at("move", "444", "after 111", 10), Dropped: at("move", "444", "before 111", 12)},
+			},
+			map[string]command{"111": commands["drop"], "222": commands["squash"], "/^WIP/": commands["drop"]},
+			[]move{{hash: "444", after: true, target: "111", pos: Position{Line: 11, Col: 1}}},
+			"",
+		},
+		"error": {
+			FailOnConflict, nil, nil, nil, "3:1: pick 111 conflicts with drop 111 at 1:1\n7:1: squash 222 333 conflicts with squash 222 111 at 4:1\n9:1: pick /^WIP/ conflicts with drop /^WIP/ at 8:1\n12:1: move 444 before 111 conflicts with move 444 after 111 at 10:1",
+		},
+	}
+
+	for k, v := range testcases {
+		t.Run(k, func(t *testing.T) {
+			p := NewPlan()
+			p.OnConflict = v.policy
+			err := p.Read(strings.NewReader(instructions))
+			if err == nil && v.expected_err != "" || err != nil && (v.expected_err == "" || !strings.Contains(err.Error(), v.expected_err)) {
+				t.Errorf("Unexpected error: got '%v', expected '%s'", err, v.expected_err)
+			}
+			if err != nil { return }
+
+			if !reflect.DeepEqual(p.Conflicts(), v.expected) { t.Errorf("Unexpected conflicts: got:\n%v\nexpected:\n%v", p.Conflicts(), v.expected) }
+			for hash, mode := range v.expected_mode {
+				if p.config[hash].mode != mode { t.Errorf("Unexpected mode for %s: got '%s', expected '%s'", hash, p.config[hash].mode, mode) }
+			}
+			if len(p.config["111"].auxiliary) != 1 { t.Errorf("Unexpected trailers for 111: %v", p.config["111"].auxiliary) }
+			if !reflect.DeepEqual(p.moves, v.expected_moves) { t.Errorf("Unexpected moves: got %v, expected %v", p.moves, v.expected_moves) }
+		})
+	}
+
+	c := Conflict{Kept: at("pick", "111", "", 3), Dropped: at("drop", "111", "", 1)}
+	if s := c.String(); s != "drop 111 at 1:1 conflicts with pick 111 at 3:1, keeping pick 111" { t.Errorf("Unexpected string for conflict: got '%s'", s) }
+	c = Conflict{Kept: Instruction{Action: "pick", Commit: "111"}, Dropped: Instruction{Action: "drop", Commit: "111", Pos: Position{File: "plan.txt", Line: 2, Col: 3}}}
+	if s := c.String(); s != "drop 111 at plan.txt:2:3 conflicts with pick 111, keeping pick 111" { t.Errorf("Unexpected string for conflict: got '%s'", s) }
+}
+
+func Test_Diagnostics(t *testing.T) {
+	p := NewPlan()
+	p.File = "plan.txt"
+	instructions := "# a comment\n\n  junk 111\npick /[/\nupdate-ref 111\nmove 222   sideways 111\nreword 333\nfixup 444 999\nsquash 555..666\n"
+	err := p.Read(strings.NewReader(instructions))
+
+	expected := Diagnostics{
+		{Position{"plan.txt", 3, 3}, "junk", "Got a junk rebase command: junk"},
+		{Position{"plan.txt", 4, 6}, "/[/", "Bad subject pattern: error parsing regexp: missing closing ]: `[`"},
+		{Position{"plan.txt", 5, 15}, "", "Missing ref name"},
+		{Position{"plan.txt", 6, 12}, "sideways 111", "Expected after or before, got 'sideways'"},
+	}
+	if !reflect.DeepEqual(err, expected) { t.Errorf("Unexpected diagnostics: got:\n%v\nexpected:\n%v", err, expected) }
+	if err != nil && !strings.HasPrefix(err.Error(), "plan.txt:3:3: Got a junk rebase command: junk\nplan.txt:4:6: ") { t.Errorf("Unexpected error: got '%s'", err) }
+
+	todo, e := Parse(strings.NewReader("pick 333 m3\n\n  pick 444 m4\npick 555 m5\n"))
+	if e != nil { t.Fatalf("Unexpected error: %s", e) }
+	todo.File = "git-rebase-todo"
+	_, err = Apply(p, todo)
+	expected = Diagnostics{
+		{Position{"git-rebase-todo", 3, 3}, "  pick 444 m4", "Can't apply fixup (subject commit is missing: 999)"},
+		{Position{"plan.txt", 9, 1}, "555..666", "Bad range 555..666: 666 isn't in the todo"},
+	}
+	if !reflect.DeepEqual(err, expected) { t.Errorf("Unexpected diagnostics: got:\n%v\nexpected:\n%v", err, expected) }
+
+	// instructions which can't be resolved don't stop the todo being checked.
+	p = NewPlan()
+	p.File = "plan.txt"
+	p.Resolve = func(name string) (string, error) { return "", fmt.Errorf("not a commit in this repository") }
+	if err := p.Read(strings.NewReader("drop nope\nfixup 444 999\n")); err != nil { t.Fatalf("Unexpected error: %s", err) }
+	_, err = Apply(p, todo)
+	expected = Diagnostics{
+		{Position{"plan.txt", 1, 6}, "nope", "Can't resolve nope: not a commit in this repository"},
+		{Position{"git-rebase-todo", 3, 3}, "  pick 444 m4", "Can't apply fixup (subject commit is missing: 999)"},
+	}
+	if !reflect.DeepEqual(err, expected) { t.Errorf("Unexpected diagnostics: got:\n%v\nexpected:\n%v", err, expected) }
+
+	p = NewPlan()
+	p.File = "plan.json"
+	err = p.ReadJSON(strings.NewReader("[\n  {\"action\": \"pick\", \"commit\": \"111\"},\n  {\"action\": \"junk\", \"commit\": \"222\"},\n\t{\"commit\": \"333\"}\n]"))
+	expected = Diagnostics{
+		{Position{"plan.json", 3, 3}, `{"action": "junk", "commit": "222"}`, "$[1].action: Got a junk rebase command: junk"},
+		{Position{"plan.json", 4, 2}, `{"commit": "333"}`, "$[2]: Missing action or trailers"},
+	}
+	if !reflect.DeepEqual(err, expected) { t.Errorf("Unexpected diagnostics: got:\n%v\nexpected:\n%v", err, expected) }
+
+	if s := (&Diagnostic{Msg: "no position"}).Error(); s != "no position" { t.Errorf("Unexpected error: got '%s'", s) }
+	if s := (&Diagnostic{Position: Position{Line: 2, Col: 5}, Msg: "no file"}).Error(); s != "2:5: no file" { t.Errorf("Unexpected error: got '%s'", s) }
+}
+
+func Test_fixup_targets(t *testing.T) {
+	testcases := map[string]struct {
+		todo string
+		expected string
+		expected_warnings []string
+		expected_err string
+	}{
+		"nearest-earlier": {
+			"pick 111 Update deps\npick 222 fixup! Update deps\npick 333 other\npick 444 Update deps\npick 555 other\npick 666 fixup! Update deps\n",
+			"pick 111 Update deps\nfixup 222 fixup! Update deps\npick 333 other\npick 444 Update deps\nfixup 666 fixup! Update deps\npick 555 other\n",
+			[]string{`6:1: Ambiguous fixup: 666 could belong to any of 111, 444, which are all titled "Update deps"; using 444, the nearest one before it`},
+			"",
+		},
+		"nested-ambiguous": {
+			"pick 111 m1\npick 222 m1\npick 333 fixup! fixup! m1\n",
+			"pick 111 m1\npick 222 m1\nfixup 333 fixup! fixup! m1\n",
+			[]string{`3:1: Ambiguous fixup: 333 could belong to any of 111, 222, which are all titled "m1"; using 222, the nearest one before it`},
+			"",
+		},
+		"by-hash": {
+			"pick 111 m1\npick 222 m2\npick 333 fixup! 111\npick 444 squash! 111\n",
+			"pick 111 m1\nfixup 333 fixup! 111\nfixup 444 squash! 111\npick 222 m2\n",
+			nil,
+			"",
+		},
+		"subject-before-hash": {
+			"pick 111 222\npick 222 m2\npick 333 fixup! 222\n",
+			"pick 111 222\nfixup 333 fixup! 222\npick 222 m2\n",
+			nil,
+			"",
+		},
+		"amend": {
+			"pick 111 m1\npick 222 m2\npick 333 amend! m1\npick 444 fixup! amend! m1\npick 555 squash! m2\n",
+			"pick 111 m1\nfixup -C 333 amend! m1\nfixup 444 fixup! amend! m1\npick 222 m2\nfixup 555 squash! m2\n",
+			nil,
+			"",
+		},
+		"amend-by-hash": {
+			"pick 111 m1\npick 222 m2\npick 333 amend! 111\n",
+			"pick 111 m1\nfixup -C 333 amend! 111\npick 222 m2\n",
+			nil,
+			"",
+		},
+		"missing-hash": {
+			"pick 111 m1\npick 333 fixup! 999\n", "", nil, "Can't apply fixup (subject commit is missing: 999)",
+		},
+	}
+
+	for k, v := range testcases {
+		t.Run(k, func(t *testing.T) {
+			p := NewPlan()
+			if err := p.Add(Instruction{Action: "fixup", Commit: "/^(fixup|squash|amend)! /"}); err != nil { t.Fatalf("Unexpected error: %s", err) }
+			todo, err := Parse(strings.NewReader(v.todo))
+			if err != nil { t.Fatalf("Unexpected error: %s", err) }
+
+			res, err := Apply(p, todo)
+			if err == nil && v.expected_err != "" || err != nil && (v.expected_err == "" || !strings.Contains(err.Error(), v.expected_err)) {
+				t.Errorf("Unexpected error: got '%v', expected '%s'", err, v.expected_err)
+			}
+			if err != nil { return }
+
+			var b bytes.Buffer
+			Format(&b, res.Todo)
+			if b.String() != v.expected { t.Errorf("Unexpected result: got:\n%s\nexpected:\n%s", b.String(), v.expected) }
+
+			var warnings []string
+			for _, w := range res.Warnings { warnings = append(warnings, w.Error()) }
+			if !reflect.DeepEqual(warnings, v.expected_warnings) { t.Errorf("Unexpected warnings: got:\n%q\nexpected:\n%q", warnings, v.expected_warnings) }
+		})
+	}
+}
+
+func Test_autosquash(t *testing.T) {
+	todo := `pick 111 Foo
+pick 222 fixup! Foo
+pick 333 squash! Foo
+pick 444 squash! fixup! Foo
+pick 555 fixup! squash! Foo
+pick 666 amend! Foo
+pick 777 other
+edit 888 fixup! fixup! Foo
+`
+	expected := `pick 111 Foo
+fixup 222 fixup! Foo
+squash 444 squash! fixup! Foo
+fixup 888 fixup! fixup! Foo
+squash 333 squash! Foo
+fixup 555 fixup! squash! Foo
+fixup -C 666 amend! Foo
+pick 777 other
+`
+	out, err := apply("autosquash default\n", todo)
+	if err != nil { t.Fatalf("Unexpected error: %s", err) }
+	if out != expected { t.Errorf("Unexpected result: got:\n%s\nexpected:\n%s", out, expected) }
+
+	for msg, mode := range map[string]command{"fixup! squash! x": "fixup", "squash! fixup! x": "squash", "amend! x": "fixup -C", "x": ""} {
+		if c := autosquash_command(msg); c != mode { t.Errorf("Unexpected command for %s: got '%s', expected '%s'", msg, c, mode) }
+	}
+	if targets := fixup_targets("fixup!  squash! x"); !reflect.DeepEqual(targets, []string{"squash! x", "x"}) { t.Errorf("Unexpected fixup targets: %q", targets) }
+}
+
+func Test_orphans(t *testing.T) {
+	todo := "pick 111 m1\npick 222 fixup! gone\npick 333 fixup! m1\npick 444 squash! also gone\npick 555 m5\n"
+	first := "pick 111 m1\npick 222 m2\n"
+
+	testcases := map[string]struct {
+		instructions string
+		todo string
+		policy OrphanPolicy
+		expected string
+		expected_warnings []string
+		expected_err string
+	}{
+		"error": {
+			"autosquash default\n", todo, OrphanError, "", nil,
+			"2:1: Can't apply fixup (subject commit is missing: gone)\n4:1: Can't apply fixup (subject commit is missing: also gone)",
+		},
+		"leave": {
+			"autosquash default\n", todo, OrphanLeave,
+			"pick 111 m1\nfixup 333 fixup! m1\npick 222 fixup! gone\npick 444 squash! also gone\npick 555 m5\n",
+			[]string{
+				"2:1: fixup 222 is a fixup of gone, which isn't in the todo; leaving it as it was",
+				"4:1: squash 444 is a fixup of also gone, which isn't in the todo; leaving it as it was",
+			},
+			"",
+		},
+		"drop": {
+			"autosquash default\n", todo, OrphanDrop,
+			"pick 111 m1\nfixup 333 fixup! m1\ndrop 222 fixup! gone\ndrop 444 squash! also gone\npick 555 m5\n",
+			[]string{
+				"2:1: fixup 222 is a fixup of gone, which isn't in the todo; dropping it",
+				"4:1: squash 444 is a fixup of also gone, which isn't in the todo; dropping it",
+			},
+			"",
+		},
+		"pick": {
+			"autosquash default\n", todo, OrphanPick,
+			"pick 111 m1\nfixup 333 fixup! m1\npick 222 fixup! gone\npick 444 squash! also gone\npick 555 m5\n",
+			[]string{
+				"2:1: fixup 222 is a fixup of gone, which isn't in the todo; picking it instead",
+				"4:1: squash 444 is a fixup of also gone, which isn't in the todo; picking it instead",
+			},
+			"",
+		},
+		"first-error": {"squash 111\n", first, OrphanError, "", nil, "1:1: Can't apply fixup (there is no commit before it)"},
+		"first-leave": {
+			"squash 111\n", first, OrphanLeave, "pick 111 m1\npick 222 m2\n",
+			[]string{"1:1: squash 111 has no commit before it to fold into; leaving it as it was"}, "",
+		},
+		"first-drop": {
+			"squash 111\n", first, OrphanDrop, "drop 111 m1\npick 222 m2\n",
+			[]string{"1:1: squash 111 has no commit before it to fold into; dropping it"}, "",
+		},
+		"first-pick": {
+			"squash 111\n", first, OrphanPick, "pick 111 m1\npick 222 m2\n",
+			[]string{"1:1: squash 111 has no commit before it to fold into; picking it instead"}, "",
+		},
+		"after-reset": {
+			"", "label onto\nreset onto\nfixup 333 m3\npick 444 m4\n", OrphanPick, "label onto\nreset onto\npick 333 m3\npick 444 m4\n",
+			[]string{"3:1: fixup 333 has no commit before it to fold into; picking it instead"}, "",
+		},
+		"todo-starts-with-fixup": {"", "fixup 111 m1\npick 222 m2\n", OrphanError, "", nil, "1:1: Can't apply fixup (there is no commit before it)"},
+		"todo-starts-with-squash": {
+			"", "squash 111 m1\npick 222 m2\n", OrphanPick, "pick 111 m1\npick 222 m2\n",
+			[]string{"1:1: squash 111 has no commit before it to fold into; picking it instead"}, "",
+		},
+		"todo-starts-with-fixup-C": {
+			"", "fixup -C 111 m1\npick 222 m2\n", OrphanLeave, "fixup -C 111 m1\npick 222 m2\n",
+			[]string{"1:1: fixup -C 111 has no commit before it to fold into; leaving it as it was"}, "",
+		},
+	}
+
+	for k, v := range testcases {
+		t.Run(k, func(t *testing.T) {
+			p := NewPlan()
+			p.OnOrphan = v.policy
+			if err := p.Read(strings.NewReader(v.instructions)); err != nil { t.Fatalf("Unexpected error: %s", err) }
+			in, err := Parse(strings.NewReader(v.todo))
+			if err != nil { t.Fatalf("Unexpected error: %s", err) }
+
+			res, err := Apply(p, in)
+			if err == nil && v.expected_err != "" || err != nil && err.Error() != v.expected_err {
+				t.Errorf("Unexpected error: got '%v', expected '%s'", err, v.expected_err)
+			}
+			if err != nil { return }
+
+			var b bytes.Buffer
+			Format(&b, res.Todo)
+			if b.String() != v.expected { t.Errorf("Unexpected result: got:\n%s\nexpected:\n%s", b.String(), v.expected) }
+
+			var warnings []string
+			for _, w := range res.Warnings { warnings = append(warnings, w.Error()) }
+			if !reflect.DeepEqual(warnings, v.expected_warnings) { t.Errorf("Unexpected warnings: got:\n%q\nexpected:\n%q", warnings, v.expected_warnings) }
+		})
+	}
+}
+
+func Test_forward_references(t *testing.T) {
+	testcases := map[string]struct {
+		instructions, todo string
+		expected string
+		expected_err string
+	}{
+		"simple": {
+			"fixup 111 333", "pick 111 a\npick 222 b\npick 333 c\n",
+			"pick 222 b\npick 333 c\nfixup 111 a\n", "",
+		},
+		"followers": {
+			"squash 111 333\nfixup 222 333",
+			"pick 111 a\nfixup 112 fixup! a\nupdate-ref refs/heads/x\npick 222 b\npick 333 c\nfixup 334 fixup! c\npick 444 d\n",
+			"pick 333 c\nfixup 334 fixup! c\nsquash 111 a\nfixup 112 fixup! a\nfixup 222 b\nupdate-ref refs/heads/x\npick 444 d\n", "",
+		},
+		"chain": {
+			"fixup 111 222\nfixup 222 333", "pick 111 a\npick 222 b\npick 333 c\n",
+			"pick 333 c\nfixup 222 b\nfixup 111 a\n", "",
+		},
+		"into-merge": {
+			"fixup 111 333", "pick 111 a\nlabel onto\nmerge -C 333 topic # Merge topic\n",
+			"label onto\nmerge -C 333 topic # Merge topic\nfixup 111 a\n", "",
+		},
+		"cycle": {
+			"fixup 111 222", "pick 111 a\nfixup 222 fixup! a\n",
+			"", "1:1: Can't apply fixup (222 would end up folded into itself)",
+		},
+		"itself": {
+			"fixup 111 111", "pick 111 a\n", "", "Can't apply fixup (subject commit is missing: 111)",
+		},
+		"missing": {
+			"fixup 111 999", "pick 111 a\n", "", "Can't apply fixup (subject commit is missing: 999)",
+		},
+	}
+
+	for k, v := range testcases {
+		t.Run(k, func(t *testing.T) {
+			out, err := apply(v.instructions, v.todo)
+			if err == nil && v.expected_err != "" || err != nil && (v.expected_err == "" || !strings.Contains(err.Error(), v.expected_err)) {
+				t.Errorf("Unexpected error: got '%v', expected '%s'", err, v.expected_err)
+			}
+			if err != nil { return }
+			if out != v.expected { t.Errorf("Unexpected result: got:\n%s\nexpected:\n%s", out, v.expected) }
+		})
+	}
+}
+
+func Test_riders(t *testing.T) {
+	todo := "exec first\npick 111 m1\nexec make test\n  x  lint\nbreak\npick 222 m2\nlabel here\nexec early\nreset here\nnoop\n"
+	expected := "exec first\nreword 222 m2\nreword 111 m1\nexec added\nexec make test\n  x  lint\nbreak\nlabel here\nexec early\nreset here\nnoop\n"
+	out, err := apply("reword default\nmove 111 after 222\nexec 111 added\n", todo)
+	if err != nil { t.Fatalf("Unexpected error: %s", err) }
+	if out != expected { t.Errorf("Unexpected result: got:\n%s\nexpected:\n%s", out, expected) }
+
+	kinds := map[string]line_kind{
+		"": verbatim_line, "# pick 111": verbatim_line, "noop": verbatim_line, "frobnicate 111": verbatim_line, "o 111": verbatim_line,
+		"pick 111 m1": commit_line, "f -C 111 m1": commit_line, "merge -C 111 topic": merge_line,
+		"label onto": anchor_line, "t onto": anchor_line, "exec make": rider_line, "b": rider_line, "update-ref refs/heads/a": ref_line,
+	}
+	for line, kind := range kinds {
+		if k, _ := classify(line, "#"); k != kind { t.Errorf("Unexpected kind for '%s': got %d, expected %d", line, k, kind) }
+	}
+
+	if _, err := apply("noop 111\n", todo); err == nil || !strings.Contains(err.Error(), "Can't use noop as an instruction") { t.Errorf("Unexpected error: got '%v'", err) }
+}
+
+func Test_prefixes(t *testing.T) {
+	todo := "pick abc1234 m1\npick abd5678 m2\npick 0123456 m3\npick 9876543 fixup! 0123456789\npick abc1999 m5\n"
+	testcases := map[string]struct {
+		instructions string
+		expected string
+		expected_err string
+	}{
+		"full-hash": {"drop abc1234deadbeefdeadbeefdeadbeefdeadbeef\n", "drop abc1234 m1\npick abd5678 m2\npick 0123456 m3\npick 9876543 fixup! 0123456789\npick abc1999 m5\n", ""},
+		"short-prefix": {"reword abd5\n", "pick abc1234 m1\nreword abd5678 m2\npick 0123456 m3\npick 9876543 fixup! 0123456789\npick abc1999 m5\n", ""},
+		"fixup-target": {"fixup 0123 abc12345\n", "pick abc1234 m1\nfixup 0123456 m3\npick abd5678 m2\npick 9876543 fixup! 0123456789\npick abc1999 m5\n", ""},
+		"fixup-subject": {"autosquash default\n", "pick abc1234 m1\npick abd5678 m2\npick 0123456 m3\nfixup 9876543 fixup! 0123456789\npick abc1999 m5\n", ""},
+		"range": {"drop abd56..01234567\n", "pick abc1234 m1\ndrop abd5678 m2\ndrop 0123456 m3\npick 9876543 fixup! 0123456789\npick abc1999 m5\n", ""},
+		"move": {"move abc12 after 0123456789abcdef\n", "pick abd5678 m2\npick 0123456 m3\npick abc1234 m1\npick 9876543 fixup! 0123456789\npick abc1999 m5\n", ""},
+		"too-short": {"reword abd\ndrop 9\n", "pick abc1234 m1\npick abd5678 m2\npick 0123456 m3\npick 9876543 fixup! 0123456789\npick abc1999 m5\n", ""},
+		"ambiguous": {"pick 111\ndrop abc1\n", "", "2:6: Ambiguous commit abc1: it could be any of abc1234, abc1999"},
+		"ambiguous-target": {"squash 0123 abc1\n", "", "Ambiguous commit abc1"},
+	}
+	for k, v := range testcases {
+		t.Run(k, func(t *testing.T) {
+			out, err := apply(v.instructions, todo)
+			if err == nil && v.expected_err != "" || err != nil && (v.expected_err == "" || !strings.Contains(err.Error(), v.expected_err)) {
+				t.Errorf("Unexpected error: got %v, expected %s", err, v.expected_err)
+			}
+			if out != v.expected { t.Errorf("Unexpected result: got:\n%s\nexpected:\n%s", out, v.expected) }
+		})
+	}
+
+	// a hash after "fixup! " has to be long enough for git to accept it, too.
+	if _, err := apply("autosquash default\n", "pick abc1234 m1\npick 9876543 fixup! abc\n"); err == nil || !strings.Contains(err.Error(), "subject commit is missing: abc") {
+		t.Errorf("Unexpected error: got '%v'", err)
+	}
+
+	p := NewPlan()
+	if err := p.Read(strings.NewReader("drop abc1234\npick abc12\nreword 999\n")); err != nil { t.Fatalf("Unexpected error: %s", err) }
+	todo_in, err := Parse(strings.NewReader(todo))
+	if err != nil { t.Fatalf("Unexpected error: %s", err) }
+	res, err := Apply(p, todo_in)
+	if err != nil { t.Fatalf("Unexpected error: %s", err) }
+	if len(res.Warnings) != 1 || res.Warnings[0].Line != 2 || !strings.Contains(res.Warnings[0].Msg, "drop abc1234 at 1:1 conflicts with pick abc12 at 2:1") {
+		t.Errorf("Unexpected warnings: %v", res.Warnings)
+	}
+	if len(res.Unmatched) != 1 || res.Unmatched[0].Commit != "999" { t.Errorf("Unexpected unmatched instructions: %v", res.Unmatched) }
+
+	p = NewPlan()
+	p.OnConflict = FailOnConflict
+	if err := p.Read(strings.NewReader("drop abc1234\npick abc12\n")); err != nil { t.Fatalf("Unexpected error: %s", err) }
+	if _, err := Apply(p, todo_in); err == nil || !strings.Contains(err.Error(), "2:1: pick abc1234 conflicts with drop abc1234 at 1:1") { t.Errorf("Unexpected error: got '%v'", err) }
+}
+
+func Test_Resolve(t *testing.T) {
+	revs := map[string]string{
+		"HEAD~2": "abc1234deadbeefdeadbeefdeadbeefdeadbeef",
+		"topic": "0123456789abcdef0123456789abcdef01234567",
+		"v1.2^": "abd5678fffffffffffffffffffffffffffffffff",
+		"old": "9999999999999999999999999999999999999999",
+		"cafe": "0123456789abcdef0123456789abcdef01234567",
+		"feed": "8888888888888888888888888888888888888888",
+	}
+	calls := 0
+	resolve := func(name string) (string, error) {
+		calls++
+		if hash, ok := revs[name]; ok { return hash, nil }
+		return "", fmt.Errorf("not a commit in this repository")
+	}
+	todo := "pick abc1234 m1\npick abd5678 m2\npick 0123456 m3\n"
+
+	testcases := map[string]struct {
+		instructions string
+		expected string
+		expected_err string
+	}{
+		"refs": {"drop HEAD~2\nreword v1.2^\nexec topic make test\n", "drop abc1234 m1\nreword abd5678 m2\npick 0123456 m3\nexec make test\n", ""},
+		"range": {"edit HEAD~2..v1.2^\n", "edit abc1234 m1\nedit abd5678 m2\npick 0123456 m3\n", ""},
+		"fixup-target": {"fixup topic HEAD~2\n", "pick abc1234 m1\nfixup 0123456 m3\npick abd5678 m2\n", ""},
+		"move": {"move HEAD~2 after topic\n", "pick abd5678 m2\npick 0123456 m3\npick abc1234 m1\n", ""},
+		"subject-target": {"fixup 0123456 m1\n", "pick abc1234 m1\nfixup 0123456 m3\npick abd5678 m2\n", ""},
+		"hex-name": {"drop cafe\nreword abc1\n", "reword abc1234 m1\npick abd5678 m2\ndrop 0123456 m3\n", ""},
+		"hex-name-elsewhere": {"drop feed\ndrop beef\n", "pick abc1234 m1\npick abd5678 m2\npick 0123456 m3\n", ""},
+		"selectors-alone": {"drop msg:m2\ndrop-ref topic\nreword default\n", "reword abc1234 m1\ndrop abd5678 m2\nreword 0123456 m3\n", ""},
+		"unresolvable": {"pick abc1234\n\ndrop nope\nfixup topic gone\n", "", "3:6: Can't resolve nope: not a commit in this repository\n4:13: Can't resolve gone: not a commit in this repository"},
+	}
+	for k, v := range testcases {
+		t.Run(k, func(t *testing.T) {
+			p := NewPlan()
+			p.Resolve = resolve
+			if err := p.Read(strings.NewReader(v.instructions)); err != nil { t.Fatalf("Unexpected error: %s", err) }
+			in, err := Parse(strings.NewReader(todo))
+			if err != nil { t.Fatalf("Unexpected error: %s", err) }
+
+			var out string
+			res, err := Apply(p, in)
+			if err == nil {
+				var b bytes.Buffer
+				err = Format(&b, res.Todo)
+				out = b.String()
+			}
+			if err == nil && v.expected_err != "" || err != nil && (v.expected_err == "" || !strings.Contains(err.Error(), v.expected_err)) {
+				t.Errorf("Unexpected error: got %v, expected %s", err, v.expected_err)
+			}
+			if out != v.expected { t.Errorf("Unexpected result: got:\n%s\nexpected:\n%s", out, v.expected) }
+		})
+	}
+
+	// names are resolved once, and the ones which aren't in the todo are unmatched, as they were given.
+	calls = 0
+	p := NewPlan()
+	p.Resolve = resolve
+	if err := p.Read(strings.NewReader("drop old\nexec old make\n")); err != nil { t.Fatalf("Unexpected error: %s", err) }
+	in, err := Parse(strings.NewReader(todo))
+	if err != nil { t.Fatalf("Unexpected error: %s", err) }
+	res, err := Apply(p, in)
+	if err != nil { t.Fatalf("Unexpected error: %s", err) }
+	if calls != 1 { t.Errorf("Unexpected number of lookups: got %d, expected 1", calls) }
+	if len(res.Unmatched) != 2 || res.Unmatched[0].Commit != "old" { t.Errorf("Unexpected unmatched instructions: %v", res.Unmatched) }
+
+	// names which can't be resolved are blamed for it, in JSON instruction files too.
+	p = NewPlan()
+	p.Resolve = resolve
+	if err := p.ReadJSON(strings.NewReader(`[{"action": "squash", "commit": "abc1234", "args": "gone"}]`)); err != nil { t.Fatalf("Unexpected error: %s", err) }
+	if _, err := Apply(p, in); err == nil || err.Error() != "1:2: $[0].args: Can't resolve gone: not a commit in this repository" { t.Errorf("Unexpected error: got '%v'", err) }
+}
+
+func Test_compile_format(t *testing.T) {
+	testcases := map[string]struct {
+		format string
+		text string
+		expected string
+	}{
+		"default": {"", "(Bob) m1", "(Bob) m1"},
+		"plain": {"%s", "(Bob) m1", "(Bob) m1"},
+		"author": {"(%an) %s", "(Bob) fixup! m1", "fixup! m1"},
+		"author-parens": {"(%an) %s", "(Bob) Fix (most) things", "Fix (most) things"},
+		"after": {"%s (%an, %ar)", "Fix (most) things (Bob, 2 days ago)", "Fix (most) things"},
+		"literal-percent": {"%%%h %s", "%abc1234 m1", "m1"},
+		"fancy": {"%C(yellow)%<(8,trunc)%aN%Creset %x09%s%d", "Bob     \tm1 (HEAD -> main)", "m1 (HEAD -> main)"},
+		"trailers": {"[%(trailers:key=Ticket,valueonly)] %s", "[ABC-1] m1", "m1"},
+		"no-subject": {"%h %an", "abc1234 Bob", "abc1234 Bob"},
+		"escaped-subject": {"%%s %b", "%s body", "%s body"},
+		"mismatch": {"(%an) %s", "no parens here", "no parens here"},
+	}
+	for k, v := range testcases {
+		t.Run(k, func(t *testing.T) {
+			if s := compile_format(v.format).subject(v.text); s != v.expected { t.Errorf("Unexpected subject: got '%s', expected '%s'", s, v.expected) }
+		})
+	}
+}
+
+func Test_InstructionFormat(t *testing.T) {
+	p := NewPlan()
+	if err := p.Read(strings.NewReader("autosquash default\nreword /^m2$/\n")); err != nil { t.Fatalf("Unexpected error: %s", err) }
+
+	todo, err := Parse(strings.NewReader("pick 111 (Alice) m1\npick 222 (Bob) m2\npick 333 (Bob) fixup! m1\n"))
+	if err != nil { t.Fatalf("Unexpected error: %s", err) }
+	todo.InstructionFormat = "(%an) %s"
+
+	res, err := Apply(p, todo)
+	if err != nil { t.Fatalf("Unexpected error: %s", err) }
+
+	var b bytes.Buffer
+	if err := Format(&b, res.Todo); err != nil { t.Fatalf("Unexpected error: %s", err) }
+	expected := "pick 111 (Alice) m1\nfixup 333 (Bob) fixup! m1\nreword 222 (Bob) m2\n"
+	if b.String() != expected { t.Errorf("Unexpected result: got:\n%s\nexpected:\n%s", b.String(), expected) }
+}
+
+func Test_CommentChar(t *testing.T) {
+	testcases := map[string]struct {
+		comment string
+		todo string
+		expected string
+		expected_comment string
+	}{
+		"default": {"", "pick 111 m1\n# pick 222 m2\n", "drop 111 m1\n# pick 222 m2\n", "#"},
+		"semicolon": {";", "pick 111 m1\n; pick 222 m2\n", "drop 111 m1\n; pick 222 m2\n", ";"},
+		"string": {"//", "pick 111 m1\n// pick 222 m2\n", "drop 111 m1\n// pick 222 m2\n", "//"},
+		"auto": {"auto", "pick 111 m1\n\n% Rebase 000..111\n", "drop 111 m1\n\n% Rebase 000..111\n", "%"},
+		"auto-none": {"auto", "pick 111 m1\n", "drop 111 m1\n", "#"},
+	}
+	for k, v := range testcases {
+		t.Run(k, func(t *testing.T) {
+			p := NewPlan()
+			if err := p.Read(strings.NewReader("drop default\n# pick 111 isn't an instruction\n")); err != nil { t.Fatalf("Unexpected error: %s", err) }
+			todo, err := Parse(strings.NewReader(v.todo))
+			if err != nil { t.Fatalf("Unexpected error: %s", err) }
+			todo.CommentChar = v.comment
+			if c := todo.comment(); c != v.expected_comment { t.Errorf("Unexpected comment: got '%s', expected '%s'", c, v.expected_comment) }
+
+			res, err := Apply(p, todo)
+			if err != nil { t.Fatalf("Unexpected error: %s", err) }
+			var b bytes.Buffer
+			if err := Format(&b, res.Todo); err != nil { t.Fatalf("Unexpected error: %s", err) }
+			if b.String() != v.expected { t.Errorf("Unexpected result: got:\n%s\nexpected:\n%s", b.String(), v.expected) }
+		})
+	}
+}
+
+func Test_CommandStyle(t *testing.T) {
+	testcases := map[string]struct {
+		style CommandStyle
+		instructions string
+		todo string
+		expected string
+	}{
+		"preserve-short": {PreserveCommands, "reword 222\nexec 111 lint\nupdate-ref 222 b\n",
+			"p 111 m1\np 222 m2\nx make\nu refs/heads/a\n",
+			"p 111 m1\nx lint\nr 222 m2\nu refs/heads/b\nx make\nu refs/heads/a\n"},
+		"preserve-long": {PreserveCommands, "fixup 333\nbreak 111\n",
+			"pick 111 m1\ns 222 m2\npick 333 m3\n",
+			"pick 111 m1\nbreak\ns 222 m2\nfixup 333 m3\n"},
+		"long": {LongCommands, "",
+			"p 111 m1\n  x  lint\nf -C 222 m2\nu refs/heads/a\nl onto\nt onto\nm -C 333 topic # M\nm topic2 # N\n",
+			"pick 111 m1\n  exec  lint\nfixup -C 222 m2\nupdate-ref refs/heads/a\nlabel onto\nreset onto\nmerge -C 333 topic # M\nmerge topic2 # N\n"},
+		"short": {ShortCommands, "break 222\ndrop 333\n",
+			"pick 111 m1\nfixup -C 222 m2\nexec make\nupdate-ref refs/heads/a\nlabel x\nmerge -C 333 topic # M\nnoop\n# pick 444\n",
+			"p 111 m1\nf -C 222 m2\nb\nx make\nu refs/heads/a\nl x\nd 333 topic # M\nnoop\n# pick 444\n"},
+	}
+	for k, v := range testcases {
+		t.Run(k, func(t *testing.T) {
+			p := NewPlan()
+			p.Style = v.style
+			if err := p.Read(strings.NewReader(v.instructions)); err != nil { t.Fatalf("Unexpected error: %s", err) }
+			todo, err := Parse(strings.NewReader(v.todo))
+			if err != nil { t.Fatalf("Unexpected error: %s", err) }
+
+			res, err := Apply(p, todo)
+			if err != nil { t.Fatalf("Unexpected error: %s", err) }
+			var b bytes.Buffer
+			if err := Format(&b, res.Todo); err != nil { t.Fatalf("Unexpected error: %s", err) }
+			if b.String() != v.expected { t.Errorf("Unexpected result: got:\n%s\nexpected:\n%s", b.String(), v.expected) }
+		})
+	}
+}
+
+func Test_update_refs(t *testing.T) {
+	testcases := map[string]struct {
+		instructions string
+		todo string
+		expected string
+	}{
+		"after-fixups": {"fixup 222 111\n", "pick 111 m1\nupdate-ref refs/heads/topic\npick 222 m2\n", "pick 111 m1\nfixup 222 m2\nupdate-ref refs/heads/topic\n"},
+		"autosquash": {"autosquash default\n", "pick 111 m1\nupdate-ref refs/heads/topic\npick 222 m2\npick 333 fixup! m1\n", "pick 111 m1\nfixup 333 fixup! m1\nupdate-ref refs/heads/topic\npick 222 m2\n"},
+		"forward": {"fixup 111 222\n", "pick 111 m1\npick 222 m2\nupdate-ref refs/heads/topic\npick 333 m3\n", "pick 222 m2\nfixup 111 m1\nupdate-ref refs/heads/topic\npick 333 m3\n"},
+		"folded-elsewhere": {"autosquash default\n", "pick 111 m1\npick 222 m2\npick 333 fixup! m1\nupdate-ref refs/heads/stack1\npick 444 m4\n", "pick 111 m1\nfixup 333 fixup! m1\npick 222 m2\nupdate-ref refs/heads/stack1\npick 444 m4\n"},
+		"folded-forward": {"fixup 111 333\n", "pick 111 m1\nupdate-ref refs/heads/a\npick 222 m2\npick 333 m3\n", "update-ref refs/heads/a\npick 222 m2\npick 333 m3\nfixup 111 m1\n"},
+		"placed": {"update-ref 111 topic\n", "pick 111 m1\npick 222 m2\nupdate-ref refs/heads/topic\n", "pick 111 m1\nupdate-ref refs/heads/topic\npick 222 m2\n"},
+		"placed-nowhere": {"update-ref 999 topic\n", "pick 111 m1\npick 222 m2\nupdate-ref refs/heads/topic\n", "pick 111 m1\npick 222 m2\nupdate-ref refs/heads/topic\n"},
+	}
+	for k, v := range testcases {
+		t.Run(k, func(t *testing.T) {
+			out, err := apply(v.instructions, v.todo)
+			if err != nil { t.Fatalf("Unexpected error: %s", err) }
+			if out != v.expected { t.Errorf("Unexpected result: got:\n%s\nexpected:\n%s", out, v.expected) }
+		})
+	}
+}
+
+func Test_empty_plan(t *testing.T) {
+	for _, todo := range []string{
+		"pick 111\n  pick  222   m2  \nfixup -C 333 m3\nf 444\tm4\nexec  make\nupdate-ref refs/heads/a\n# comment\nmerge -C 555  topic # M\nlabel  x\npick 666 m6",
+		"pick 111 m1\r\npick 222 m2\r\n",
+		"pick 1111 A\n\nexec make\n# c\nupdate-ref refs/heads/x\n",
+		"pick 1111 A\nupdate-ref   refs/heads/x\n  exec make\nfixup 2222 B\nupdate-ref refs/heads/y\n",
+		"",
+	} {
+		out, err := apply("", todo)
+		if err != nil { t.Fatalf("Unexpected error: %s", err) }
+		if out != todo { t.Errorf("Unexpected result: got:\n%q\nexpected:\n%q", out, todo) }
+	}
+}
@@ -0,0 +1,125 @@
+package respin
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// selector picks out commits by their subject or their position, rather than their hash. key is
+// the selector as it was written, which is also where its reaction is kept in the plan.
+// subject selectors have match set, and range selectors have from and to set instead.
+type selector struct {
+	key string
+	match func(subject string) bool
+	from, to string
+	// pos is where the selector was first given, for diagnostics.
+	pos Position
+}
+
+// how far a range selector has got, while the todo is being read.
+const (
+	range_before = iota
+	range_inside
+	range_after
+	range_backward
+	range_reversed
+)
+
+// parse_selector turns key into a selector. there are three kinds:
+//     /REGEX/       the subject matches REGEX
+//     msg:TEXT      the subject contains TEXT, which may be a double quoted go string
+//     FROM..TO      everything from FROM through TO in the todo, including both. either may
+//                   be left out to mean the start or the end of the todo.
+// if key isn't a selector at all (because it's a hash, or default), nil is returned.
+func parse_selector(key string) (*selector, error) {
+	switch {
+	case strings.HasPrefix(key, "/"):
+		if len(key) < 2 || !strings.HasSuffix(key, "/") { return nil, fmt.Errorf("Unterminated subject pattern: %s", key) }
+		re, err := regexp.Compile(key[1:len(key) - 1])
+		if err != nil { return nil, fmt.Errorf("Bad subject pattern: %s", err) }
+		return &selector{key: key, match: re.MatchString}, nil
+	case strings.HasPrefix(key, "msg:"):
+		text := key[len("msg:"):]
+		if strings.HasPrefix(text, `"`) {
+			var err error
+			text, err = strconv.Unquote(text)
+			if err != nil { return nil, fmt.Errorf("Bad quoted subject: %s", key) }
+		}
+		if len(text) == 0 { return nil, fmt.Errorf("Empty subject: %s", key) }
+		return &selector{key: key, match: func(subject string) bool { return strings.Contains(subject, text) }}, nil
+	case strings.Contains(key, "..."):
+		return nil, fmt.Errorf("Bad range: %s (did you mean ..?)", key)
+	case strings.Contains(key, ".."):
+		i := strings.Index(key, "..")
+		if key == ".." { return nil, fmt.Errorf("Empty range: %s", key) }
+		return &selector{key: key, from: key[:i], to: key[i + 2:]}, nil
+	}
+	return nil, nil
+}
+
+// matches reports whether the selector picks the commit with the given hash and subject.
+// ranges holds how far each range selector has got, and commits must be checked in todo order.
+func (s *selector) matches(ranges map[*selector]int, hash, subject string) bool {
+	if s.match != nil { return s.match(subject) }
+
+	state := ranges[s]
+	if state == range_before && (s.from == "" || s.from == hash) { state = range_inside }
+	if state == range_backward && s.from == hash { state = range_reversed }
+	matched := state == range_inside
+	if s.to == hash {
+		if state == range_before {
+			state = range_backward
+		} else if state == range_inside {
+			state = range_after
+		}
+	}
+	ranges[s] = state
+	return matched
+}
+
+// check_range complains about a range selector which didn't make sense for the whole todo.
+func (s *selector) check_range(ranges map[*selector]int) error {
+	if s.match != nil { return nil }
+
+	switch ranges[s] {
+	case range_before, range_backward:
+		if s.from != "" { return fmt.Errorf("Bad range %s: %s isn't in the todo", s.key, s.from) }
+	case range_inside:
+		if s.to != "" { return fmt.Errorf("Bad range %s: %s isn't in the todo", s.key, s.to) }
+	case range_reversed:
+		return fmt.Errorf("Bad range %s: %s comes before %s in the todo", s.key, s.to, s.from)
+	}
+	return nil
+}
+
+// closing finds the first unescaped delim in s, starting at i. it returns -1 if there isn't one.
+func closing(s string, i int, delim byte) int {
+	for ; i < len(s); i++ {
+		if s[i] == '\\' {
+			i++
+		} else if s[i] == delim {
+			return i
+		}
+	}
+	return -1
+}
+
+// grab_selector works like grab, except that /REGEX/ and msg:"TEXT" selectors are taken whole,
+// even if they contain whitespace.
+func grab_selector(s string) (string, string) {
+	t := strings.TrimLeftFunc(s, unicode.IsSpace)
+
+	end := -1
+	if strings.HasPrefix(t, "/") {
+		end = closing(t, 1, '/')
+	} else if strings.HasPrefix(t, `msg:"`) {
+		end = closing(t, len(`msg:"`), '"')
+	}
+
+	// an unterminated selector is grabbed like anything else, and complained about later.
+	if end == -1 { return grab(s) }
+	return t[:end + 1], strings.TrimLeftFunc(t[end + 1:], unicode.IsSpace)
+}
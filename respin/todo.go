@@ -0,0 +1,112 @@
+package respin
+
+import (
+	"bytes"
+	"io"
+	"strings"
+)
+
+// Line is one line of a rebase todo file.
+type Line struct {
+	// Text is the content of the line, without its line ending.
+	Text string
+	// End is the line ending, "\n" or "\r\n", or empty for a last line which has none.
+	End string
+}
+
+// Todo is a rebase todo file, as a list of lines.
+// Parse and Format round trip any todo file byte for byte.
+type Todo struct {
+	Lines []Line
+	// File names the todo file, for diagnostics. Parse leaves it empty.
+	File string
+	// InstructionFormat is git's rebase.instructionFormat, which says what git wrote after the
+	// hash of each commit. Subjects are pulled out of it to match fixups and selectors against.
+	// Empty means %s, just the subject, which is git's default. Parse leaves it empty, and
+	// ConfiguredInstructionFormat reads it from git.
+	InstructionFormat string
+	// CommentChar is git's core.commentChar, which starts the comment lines in the todo. It may
+	// be more than one character, like core.commentString. Empty means #, which is git's
+	// default, and auto means whichever of git's choices for auto the todo's comments start
+	// with. Parse leaves it empty, and ConfiguredCommentChar reads it from git.
+	CommentChar string
+}
+
+// Parse reads a rebase todo file.
+func Parse(r io.Reader) (*Todo, error) {
+	data, err := io.ReadAll(r)
+	if err != nil { return nil, err }
+
+	t := &Todo{}
+	for len(data) != 0 {
+		var l Line
+		i := bytes.IndexByte(data, '\n')
+		if i == -1 {
+			l.Text, data = string(data), nil
+		} else {
+			l.Text, l.End, data = string(data[:i]), "\n", data[i + 1:]
+			if n := len(l.Text); n != 0 && l.Text[n - 1] == '\r' { l.Text, l.End = l.Text[:n - 1], "\r\n" }
+		}
+		t.Lines = append(t.Lines, l)
+	}
+	return t, nil
+}
+
+// Format writes a rebase todo file.
+func Format(w io.Writer, t *Todo) error {
+	var b bytes.Buffer
+	for _, l := range t.Lines {
+		b.WriteString(l.Text)
+		b.WriteString(l.End)
+	}
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+// eol picks the line ending to use for new lines, which is whatever the todo already uses.
+func (t *Todo) eol() string {
+	for _, l := range t.Lines {
+		if l.End != "" { return l.End }
+	}
+	return "\n"
+}
+
+// auto_comment_chars are the characters git picks from when core.commentChar is auto.
+const auto_comment_chars = "#;@!$%^&|:"
+
+// comment returns what comment lines in the todo start with.
+func (t *Todo) comment() string {
+	switch t.CommentChar {
+	case "":
+		return "#"
+	case "auto":
+		// no command starts with any of them, so the first line starting with one is a comment.
+		for _, l := range t.Lines {
+			line := strings.TrimSpace(l.Text)
+			if line != "" && strings.IndexByte(auto_comment_chars, line[0]) != -1 { return line[:1] }
+		}
+		return "#"
+	}
+	return t.CommentChar
+}
+
+// texts returns the text of each line in the todo.
+func (t *Todo) texts() []string {
+	out := make([]string, len(t.Lines))
+	for i, l := range t.Lines { out[i] = l.Text }
+	return out
+}
+
+// line_scanner feeds the lines of a todo to something that expects a myscanner.
+type line_scanner struct {
+	lines []Line
+	n int
+}
+
+func (s *line_scanner) Scan() bool {
+	if s.n >= len(s.lines) { return false }
+	s.n++
+	return true
+}
+
+func (s *line_scanner) Text() string { return s.lines[s.n - 1].Text }